@@ -0,0 +1,107 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+// castagnoli is the CRC32C table used to checksum Def records
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptRecordError is returned when a record in a stream fails verification
+// (its checksum, or the trailer, does not match the bytes reassembled so far)
+type CorruptRecordError struct {
+	Record uint64 // index of the record in the stream (0 is the first one)
+	Offset uint64 // offset in the output at which the record's bytes belong
+	Reason string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("Corrupt record %d at output offset %d: %s",
+		e.Record, e.Offset, e.Reason)
+}
+
+// streamDigest accumulates the length and digest of a reassembled stream. It
+// is written to (as an io.Writer) with the output, in order.
+type streamDigest struct {
+	digest hash.Hash
+	total  uint64
+}
+
+func newStreamDigest() *streamDigest {
+	return &streamDigest{digest: sha512.New()}
+}
+
+func (s *streamDigest) Write(p []byte) (int, error) {
+	s.digest.Write(p)
+	s.total += uint64(len(p))
+	return len(p), nil
+}
+
+// trailer returns the Trailer message describing the stream written so far
+func (s *streamDigest) trailer() codec.Message {
+	return codec.Message{
+		Type:       codec.MessageTrailer,
+		TotalBytes: s.total,
+		Digest:     s.digest.Sum(nil),
+	}
+}
+
+// verifier checks the records of a stream written with FlagChecksums, it must
+// see each record before the record's bytes are written to the output
+type verifier struct {
+	*streamDigest
+	record  uint64 // index of the next record
+	trailed bool   // whether the trailer has been seen
+}
+
+func newVerifier() *verifier {
+	return &verifier{streamDigest: newStreamDigest()}
+}
+
+// check verifies the message (the next record in the stream)
+func (v *verifier) check(msg *codec.Message) error {
+	record := v.record
+	v.record++
+	corrupt := func(reason string, args ...interface{}) error {
+		return &CorruptRecordError{
+			Record: record,
+			Offset: v.total,
+			Reason: fmt.Sprintf(reason, args...),
+		}
+	}
+
+	if v.trailed {
+		return corrupt("unexpected record after the trailer")
+	}
+	switch msg.Type {
+	case codec.MessageDef:
+		if sum := crc32.Checksum(msg.DefBytes, castagnoli); sum != msg.Checksum {
+			return corrupt("checksum mismatch (%08x, expected %08x)", sum, msg.Checksum)
+		}
+	case codec.MessageTrailer:
+		v.trailed = true
+		if msg.TotalBytes != v.total {
+			return corrupt("length mismatch (%d bytes, expected %d)", v.total, msg.TotalBytes)
+		}
+		if !bytes.Equal(v.digest.Sum(nil), msg.Digest) {
+			return corrupt("digest mismatch")
+		}
+	}
+	return nil
+}
+
+// finish verifies that the stream (all of which has been checked) was whole
+func (v *verifier) finish() error {
+	if !v.trailed {
+		return errors.Errorf("Stream truncated: no trailer after %d records (%d bytes)",
+			v.record, v.total)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+var codecs = []codec.Kind{codec.KindGob, codec.KindBinary, codec.KindProtobuf}
+
+// dedupMessages dedups data (with checksums, in the given codec) and returns
+// the header and the records of the stream
+func dedupMessages(t *testing.T, kind codec.Kind, data []byte) (codec.Header, []codec.Message) {
+	d, err := NewDeduplicatorWithOptions(Options{
+		Segmenter: testSegmenter(t, AlgorithmBuzhash),
+		Codec:     kind,
+		Checksums: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	stream := bytes.Buffer{}
+	if err := d.Do(bytes.NewReader(data), &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	input := bufio.NewReader(&stream)
+	header, err := codec.ReadHeader(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := codec.NewReader(header.Codec, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []codec.Message{}
+	for {
+		msg, err := reader.Read()
+		if err == io.EOF {
+			return header, msgs
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		msg.DefBytes = append([]byte{}, msg.DefBytes...)
+		msg.Digest = append([]byte{}, msg.Digest...)
+		msgs = append(msgs, msg)
+	}
+}
+
+// encodeStream returns the stream with the given header and records
+func encodeStream(t *testing.T, header codec.Header, msgs []codec.Message) []byte {
+	stream := bytes.Buffer{}
+	if err := codec.WriteHeader(&stream, header); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := codec.NewWriter(header.Codec, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range msgs {
+		if err := writer.Write(&msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stream.Bytes()
+}
+
+// redupStream reduplicates the stream, returning the error (if any)
+func redupStream(stream []byte) error {
+	r := NewReduplicator()
+	defer r.Close()
+	return r.Do(bytes.NewReader(stream), ioutil.Discard)
+}
+
+// corruptRecord returns the CorruptRecordError (or fails the test)
+func corruptRecord(t *testing.T, err error) *CorruptRecordError {
+	corrupt, ok := errors.Cause(err).(*CorruptRecordError)
+	if !ok {
+		t.Fatalf("Expected a CorruptRecordError, got %v", err)
+	}
+	return corrupt
+}
+
+func TestCorruptDef(t *testing.T) {
+	data := testInput(1<<20, 20)
+	for _, kind := range codecs {
+		t.Run(kind.String(), func(t *testing.T) {
+			header, msgs := dedupMessages(t, kind, data)
+			if err := redupStream(encodeStream(t, header, msgs)); err != nil {
+				t.Fatal(err)
+			}
+
+			// flip a byte of a Def halfway through the stream, after some Refs
+			var (
+				lengths = map[uint64]uint64{}
+				offset  = uint64(0)
+				refs    = 0
+				record  = -1
+			)
+			for i, msg := range msgs {
+				if msg.Type == codec.MessageDef && i >= len(msgs)/2 && refs > 0 {
+					record = i
+					break
+				}
+				switch msg.Type {
+				case codec.MessageDef:
+					lengths[msg.DefID] = uint64(len(msg.DefBytes))
+					offset += uint64(len(msg.DefBytes))
+				case codec.MessageRef:
+					offset += lengths[msg.RefID]
+					refs++
+				}
+			}
+			if record < 0 {
+				t.Fatalf("No Def after a Ref in the second half of the stream")
+			}
+			msgs[record].DefBytes[len(msgs[record].DefBytes)/2] ^= 0x10
+
+			corrupt := corruptRecord(t, redupStream(encodeStream(t, header, msgs)))
+			if corrupt.Record != uint64(record) || corrupt.Offset != offset {
+				t.Fatalf("Got corrupt record %d at offset %d, expected record %d at offset %d",
+					corrupt.Record, corrupt.Offset, record, offset)
+			}
+		})
+	}
+}
+
+func TestCorruptTrailer(t *testing.T) {
+	data := testInput(1<<20, 21)
+	for _, kind := range codecs {
+		t.Run(kind.String(), func(t *testing.T) {
+			header, msgs := dedupMessages(t, kind, data)
+			last := len(msgs) - 1
+			if msgs[last].Type != codec.MessageTrailer {
+				t.Fatalf("Stream ends with a message of type %d, not the trailer", msgs[last].Type)
+			}
+
+			err := redupStream(encodeStream(t, header, msgs[:last]))
+			if err == nil || !strings.Contains(err.Error(), "no trailer") {
+				t.Fatalf("Expected an error for a stream without its trailer, got %v", err)
+			}
+
+			for _, tamper := range []func(*codec.Message){
+				func(m *codec.Message) { m.Digest[0] ^= 1 },
+				func(m *codec.Message) { m.Digest = m.Digest[1:] },
+				func(m *codec.Message) { m.TotalBytes++ },
+				func(m *codec.Message) { m.TotalBytes-- },
+			} {
+				tampered := append([]codec.Message{}, msgs...)
+				tampered[last].Digest = append([]byte{}, msgs[last].Digest...)
+				tamper(&tampered[last])
+
+				corrupt := corruptRecord(t, redupStream(encodeStream(t, header, tampered)))
+				if corrupt.Record != uint64(last) || corrupt.Offset != uint64(len(data)) {
+					t.Fatalf("Got corrupt record %d at offset %d, expected record %d at offset %d",
+						corrupt.Record, corrupt.Offset, last, len(data))
+				}
+			}
+		})
+	}
+}
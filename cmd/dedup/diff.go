@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/amoghe/dedup"
+	"github.com/amoghe/dedup/codec"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	diffCmd = kingpin.Command("diff", "Write a patch that turns OLD into NEW")
+	diffOld = diffCmd.Arg("old", "Old file").
+			Required().
+			File()
+	diffNew = diffCmd.Arg("new", "New file").
+			Required().
+			File()
+	diffOut = diffCmd.Flag("output", "Patch file to write (stdout if omitted)").
+			Short('o').
+			String()
+	diffFromSig = diffCmd.Flag("from-signature", "OLD is a signature of the old file (made by the signature command)").
+			Short('s').
+			Bool()
+	diffReverse = diffCmd.Flag("reverse", "Also write the patch that turns NEW back into OLD to this file").
+			Short('r').
+			String()
+
+	patchCmd = kingpin.Command("patch", "Apply a patch (made by diff) to OLD, recreating NEW")
+	patchOld = patchCmd.Arg("old", "Old file").
+			Required().
+			File()
+	patchFiles = patchCmd.Arg("patch", "Patch file (several with --chain)").
+			Required().
+			ExistingFiles()
+	patchChain = patchCmd.Flag("chain", "Apply the patches (e.g. v1->v2, v2->v3) in sequence, in a single pass").
+			Bool()
+	patchOut = patchCmd.Flag("output", "New file to write (stdout if omitted)").
+			Short('o').
+			String()
+
+	sigCmd = kingpin.Command("signature", "Write a signature of OLD, to diff against without OLD itself")
+	sigOld = sigCmd.Arg("old", "Old file").
+			Required().
+			File()
+	sigOut = sigCmd.Flag("output", "Signature file to write (stdout if omitted)").
+			Short('o').
+			String()
+)
+
+// doDiff writes a patch between the old and new files, made with the same
+// segmenter flags as deduplication
+func doDiff(ctx context.Context) {
+	defer (*diffOld).Close()
+	defer (*diffNew).Close()
+	if *diffFromSig && *diffReverse != "" {
+		fatal("Reverse patches need the old file, not a signature")
+	}
+
+	differ, err := dedup.NewDifferWithOptions(optionsFromFlags())
+	if err != nil {
+		fatal("Failed to setup differ:", err)
+	}
+
+	out := createOutput(*diffOut)
+	var (
+		newFile = dedup.NewCountingReader(*diffNew)
+		patch   = dedup.NewCountingWriter(out)
+		store   *dedup.SpillStore
+	)
+	if *diffFromSig {
+		sig, sigErr := dedup.ReadSignature(*diffOld)
+		if sigErr != nil {
+			fatal("Failed to read signature:", sigErr)
+		}
+		checkSegmenterFlags(sig.Header, "signature")
+		err = differ.MakePatchFromSignatureContext(ctx, sig, newFile, patch)
+	} else if *diffReverse != "" {
+		reverse := createOutput(*diffReverse)
+		if *maxMemory > 0 {
+			store = dedup.NewSpillStore(int64(*maxMemory), *spillDir)
+			defer store.Close()
+			differ.SetStore(store)
+		}
+		err = differ.MakePatchesContext(ctx, *diffOld, newFile, patch, reverse)
+	} else {
+		err = differ.MakePatchContext(ctx, *diffOld, newFile, patch)
+	}
+	if err != nil {
+		if store != nil {
+			store.Close() // fatal skips the deferred Close
+		}
+		fatal("Failed to make patch:", err)
+	}
+	commitOutputs()
+
+	if *quiet == false {
+		printPatchStats(newFile.Count(), patch.Count())
+	}
+}
+
+// doPatch applies the patch to the old file, recreating the new one
+func doPatch(ctx context.Context) {
+	defer (*patchOld).Close()
+	if len(*patchFiles) > 1 && !*patchChain {
+		fatal("Several patches given, use --chain to apply them in sequence")
+	}
+
+	patches := []io.Reader{}
+	counts := []*dedup.CountingReader{}
+	for _, name := range *patchFiles {
+		file, err := os.Open(name)
+		if err != nil {
+			fatal("Failed to open patch:", err)
+		}
+		defer file.Close()
+		header, err := codec.ReadHeader(bufio.NewReader(file))
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			fatal("Failed to read patch:", err)
+		}
+		checkSegmenterFlags(header, "patch")
+		counted := dedup.NewCountingReader(file)
+		patches = append(patches, counted)
+		counts = append(counts, counted)
+	}
+
+	differ, err := dedup.NewDifferWithOptions(optionsFromFlags())
+	if err != nil {
+		fatal("Failed to setup differ:", err)
+	}
+
+	out := createOutput(*patchOut)
+	newFile := dedup.NewCountingWriter(out)
+	if err := differ.ApplyPatchChainContext(ctx, *patchOld, patches, newFile); err != nil {
+		fatal("Failed to apply patch:", err)
+	}
+	commitOutputs()
+
+	if *quiet == false {
+		patchBytes := uint64(0)
+		for _, counted := range counts {
+			patchBytes += counted.Count()
+		}
+		printPatchStats(newFile.Count(), patchBytes)
+	}
+}
+
+// doSignature writes the signature of the old file
+func doSignature(ctx context.Context) {
+	defer (*sigOld).Close()
+
+	differ, err := dedup.NewDifferWithOptions(optionsFromFlags())
+	if err != nil {
+		fatal("Failed to setup differ:", err)
+	}
+	sig, err := differ.MakeSignatureContext(ctx, *sigOld)
+	if err != nil {
+		fatal("Failed to make signature:", err)
+	}
+
+	out := createOutput(*sigOut)
+	if err := dedup.WriteSignature(out, sig); err != nil {
+		fatal("Failed to write signature:", err)
+	}
+	commitOutputs()
+}
+
+// checkSegmenterFlags fails if segmenter flags given on the cmdline conflict
+// with the chunker params (and, for a patch, the LRU window) recorded in a patch
+// or signature (which are what the old file is segmented with)
+func checkSegmenterFlags(header codec.Header, what string) {
+	if header.Version == 0 {
+		return // legacy streams don't record any
+	}
+	var (
+		set       = flagsSetByUser()
+		conflicts = []string{}
+	)
+	if algo := dedup.Algorithm(header.Chunker); set["chunker"] && *chunker != algo.String() {
+		conflicts = append(conflicts, fmt.Sprintf("--chunker %s (%s has %s)", *chunker, what, algo))
+	}
+	check := func(flag string, ours, theirs uint64) {
+		if set[flag] && ours != 0 && ours != theirs {
+			conflicts = append(conflicts, fmt.Sprintf("--%s %d (%s has %d)", flag, ours, what, theirs))
+		}
+	}
+	check("window", *windowSize, header.WindowSize)
+	check("min", *minSegment, header.MinSegmentLength)
+	check("avg", *avgSegment, header.AvgSegmentLength)
+	check("max", *maxSegment, header.MaxSegmentLength)
+	if header.Flags&codec.FlagPatch != 0 {
+		check("lru-segments", uint64(*lruSegments), header.LRUSegments)
+		check("lru-bytes", uint64(*lruBytes), header.LRUBytes)
+	}
+	if mask := uint64((1 << *zeroBits) - 1); set["zerobits"] && mask != header.Mask {
+		conflicts = append(conflicts, fmt.Sprintf("--zerobits %d (%s has mask %#x)", *zeroBits, what, header.Mask))
+	}
+	if len(conflicts) > 0 {
+		fatal(fmt.Sprintf("Flags conflict with the params recorded in the %s: %s", what, strings.Join(conflicts, ", ")))
+	}
+}
+
+// createOutput creates the named output file (which is only put in place by
+// commitOutputs), or returns stdout if name is ""
+func createOutput(name string) io.Writer {
+	if name == "" {
+		return os.Stdout
+	}
+	out, err := createOutputFile(name, 0666)
+	if err != nil {
+		fatal("Failed to setup output stream:", err)
+	}
+	return out
+}
+
+// printPatchStats prints the size of the patch relative to the new file
+func printPatchStats(newBytes, patchBytes uint64) {
+	ratio := 0.0
+	if newBytes > 0 {
+		ratio = float64(patchBytes) / float64(newBytes)
+	}
+	output := struct {
+		NewBytes   uint64
+		PatchBytes uint64
+		PatchRatio float64 // PatchBytes / NewBytes
+	}{
+		NewBytes:   newBytes,
+		PatchBytes: patchBytes,
+		PatchRatio: ratio,
+	}
+
+	marshalled, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		fatal("Failed to marshal stats:", err)
+	}
+	fmt.Fprintln(os.Stderr, string(marshalled))
+}
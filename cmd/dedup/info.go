@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/amoghe/dedup"
+	"github.com/amoghe/dedup/codec"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	infoCmd  = kingpin.Command("info", "Print the header of a dedup stream (or signature)")
+	infoFile = infoCmd.Arg("file", "Dedup stream (reads stdin if omitted)").
+			File()
+)
+
+// doInfo prints the header of the specified dedup stream
+func doInfo() {
+	input := os.Stdin
+	if *infoFile != nil {
+		input = *infoFile
+		defer input.Close()
+	}
+
+	header, err := codec.ReadHeader(bufio.NewReader(input))
+	if err != nil {
+		log.Fatalln("Failed to read header:", err)
+	}
+
+	flags := []string{}
+	if header.Flags&codec.FlagForget != 0 {
+		flags = append(flags, "forget")
+	}
+	if header.Flags&codec.FlagChecksums != 0 {
+		flags = append(flags, "checksums")
+	}
+	if header.Flags&codec.FlagPatch != 0 {
+		flags = append(flags, "patch")
+	}
+	if header.Flags&codec.FlagCopy != 0 {
+		flags = append(flags, "copy")
+	}
+	if header.Flags&codec.FlagSignature != 0 {
+		flags = append(flags, "signature")
+	}
+
+	output := struct {
+		Version          uint8
+		Codec            string
+		Hash             string
+		Flags            []string
+		Chunker          string
+		WindowSize       uint64
+		Mask             string
+		MinSegmentLength uint64
+		AvgSegmentLength uint64
+		MaxSegmentLength uint64
+		LRUSegments      uint64 `json:",omitempty"`
+		LRUBytes         uint64 `json:",omitempty"`
+		BaseSize         uint64 `json:",omitempty"`
+		BaseDigest       string `json:",omitempty"`
+		BaseIDs          uint64 `json:",omitempty"`
+	}{
+		Version:          header.Version,
+		Codec:            header.Codec.String(),
+		Hash:             "sha512",
+		Flags:            flags,
+		Chunker:          dedup.Algorithm(header.Chunker).String(),
+		WindowSize:       header.WindowSize,
+		Mask:             fmt.Sprintf("%#x", header.Mask),
+		MinSegmentLength: header.MinSegmentLength,
+		AvgSegmentLength: header.AvgSegmentLength,
+		MaxSegmentLength: header.MaxSegmentLength,
+		LRUSegments:      header.LRUSegments,
+		LRUBytes:         header.LRUBytes,
+		BaseSize:         header.BaseSize,
+		BaseIDs:          header.BaseIDs,
+	}
+	if len(header.BaseDigest) > 0 {
+		output.BaseDigest = fmt.Sprintf("%x", header.BaseDigest)
+	}
+	if header.Version == 0 {
+		// legacy streams have no header, so nothing is known about the chunker
+		output.Chunker = "unknown"
+	}
+
+	marshalled, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		log.Fatalln("Failed to marshal header:", err)
+	}
+	fmt.Println(string(marshalled))
+}
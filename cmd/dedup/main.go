@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/amoghe/dedup"
+	"github.com/amoghe/dedup/codec"
 	"github.com/pkg/profile"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -19,6 +24,8 @@ const (
 	DefaultWindowSize = "64"
 	// DefaultZeroBits is the bitbank which must be 0 to identify a segment boundary
 	DefaultZeroBits = "16"
+	// DefaultChunker is the chunking algorithm used to find segment boundaries
+	DefaultChunker = "buzhash"
 )
 
 var (
@@ -28,9 +35,46 @@ var (
 	windowSize = kingpin.Flag("window", "Fingerprint window size (bytes)").
 			Default(DefaultWindowSize).
 			Uint64()
+	chunker = kingpin.Flag("chunker", "Chunking algorithm (buzhash, rabin, gear, fastcdc)").
+			Default(DefaultChunker).
+			Enum("buzhash", "rabin", "gear", "fastcdc")
+	minSegment = kingpin.Flag("min", "Minimum segment length (bytes, 0 to derive)").
+			Default("0").
+			Uint64()
+	avgSegment = kingpin.Flag("avg", "Average segment length (bytes, power of 2, overrides zerobits)").
+			Default("0").
+			Uint64()
+	maxSegment = kingpin.Flag("max", "Maximum segment length (bytes, 0 to derive)").
+			Default("0").
+			Uint64()
+	codecName = kingpin.Flag("codec", "Encoding of the deduplicated stream (gob, binary, protobuf)").
+			Default("gob").
+			Enum("gob", "binary", "protobuf")
+	checksums = kingpin.Flag("checksum", "Checksum segments and the whole stream (--no-checksum to disable)").
+			Default("true").
+			Bool()
+	workers = kingpin.Flag("workers", "Number of goroutines to segment and hash with").
+			Short('j').
+			Default("1").
+			Int()
 	reduplicate = kingpin.Flag("decompress", "Recover original file (redup)").
 			Short('d').
 			Bool()
+	maxMemory = kingpin.Flag("max-memory", "Segment bytes to hold in memory when recovering or making reverse patches (e.g. 512MB, 0 is unlimited)").
+			Default("0").
+			Bytes()
+	indexCache = kingpin.Flag("index-cache", "Segments to track in memory, the rest go to an on-disk index (0 is unlimited)").
+			Default("0").
+			Int()
+	lruSegments = kingpin.Flag("lru-segments", "Forget all but the most recently used N segments (0 is unlimited)").
+			Default("0").
+			Int()
+	lruBytes = kingpin.Flag("lru-bytes", "Forget all but the most recently used segments totalling N bytes (e.g. 1GB, 0 is unlimited)").
+			Default("0").
+			Bytes()
+	spillDir = kingpin.Flag("spill-dir", "Directory for on-disk segment stores and indexes").
+			Default(os.TempDir()).
+			String()
 	memProfile = kingpin.Flag("memprofile", "Enable memory profiling").
 			Bool()
 	toStdout = kingpin.Flag("stdout", "Write to stdout").
@@ -39,12 +83,40 @@ var (
 	quiet = kingpin.Flag("quiet", "suppress all stats").
 			Short('q').
 			Bool()
-	inputFile = kingpin.Arg("infile", "File to be {de|re}duplicated").
+	showProgress = kingpin.Flag("progress", "Show progress on stderr").
+			Short('v').
+			Bool()
+
+	runCmd = kingpin.Command("run", "{De|Re}duplicate a file or stdin (the default command)").
+		Default()
+	inputFile = runCmd.Arg("infile", "File to be {de|re}duplicated").
 			File()
 )
 
+// outputs are the output files being written, they are only put in place
+// (see outputFile) by commitOutputs, once the output is complete
+var outputs []*outputFile
+
 func main() {
-	kingpin.Parse()
+	ctx := signalContext()
+
+	switch kingpin.Parse() {
+	case infoCmd.FullCommand():
+		doInfo()
+		return
+	case verifyCmd.FullCommand():
+		doVerify(ctx)
+		return
+	case diffCmd.FullCommand():
+		doDiff(ctx)
+		return
+	case patchCmd.FullCommand():
+		doPatch(ctx)
+		return
+	case sigCmd.FullCommand():
+		doSignature(ctx)
+		return
+	}
 
 	if *windowSize <= 1 {
 		log.Fatalln("Window too small (<=1)")
@@ -65,16 +137,39 @@ func main() {
 	}
 
 	defer source.Close()
-	defer sink.Close()
 	if *memProfile {
 		defer profile.Start(profile.MemProfile).Stop()
 	}
 
 	if *reduplicate {
-		doReduplication(source, sink)
+		doReduplication(ctx, source, sink)
 	} else {
-		doDeduplication(source, sink)
+		doDeduplication(ctx, source, sink)
+	}
+	commitOutputs()
+}
+
+// signalContext returns a context that is canceled on SIGINT or SIGTERM. Only
+// the first signal is caught, a second one kills the process as usual.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+// fatal removes the partially written outputs (if any) and exits
+func fatal(v ...interface{}) {
+	for _, out := range outputs {
+		out.File.Close()
+		os.Remove(out.File.Name())
 	}
+	log.Fatalln(v...)
 }
 
 func getInputStream() (io.ReadCloser, error) {
@@ -84,7 +179,7 @@ func getInputStream() (io.ReadCloser, error) {
 	return *inputFile, nil
 }
 
-func getOutputStream() (io.WriteCloser, error) {
+func getOutputStream() (io.Writer, error) {
 	if *inputFile == nil || *toStdout == true {
 		return os.Stdout, nil
 	}
@@ -105,25 +200,164 @@ func getOutputStream() (io.WriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return os.OpenFile(outFileName, os.O_CREATE|os.O_RDWR, inStat.Mode())
+	return createOutputFile(outFileName, inStat.Mode())
+}
+
+// outputFile is an output file being written. It is written to a temporary
+// file (next to it) that is only renamed to the output's name on Close, so an
+// existing file is left alone unless the output is complete.
+type outputFile struct {
+	*os.File
+	name string
 }
 
-func doDeduplication(in io.Reader, out io.Writer) {
-	dedup := dedup.NewDeduplicator(*windowSize, uint64((1<<*zeroBits)-1))
-	if err := dedup.Do(in, out); err != nil {
-		log.Fatalln("Failed to deduplicate:", err)
+// createOutputFile creates the temporary file for the named output
+func createOutputFile(name string, perm os.FileMode) (*outputFile, error) {
+	tmpName := fmt.Sprintf("%s.%d.tmp", name, os.Getpid())
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return nil, err
+	}
+	out := &outputFile{File: file, name: name}
+	outputs = append(outputs, out)
+	return out, nil
+}
+
+// Close closes the temporary file and renames it to the output's name
+func (o *outputFile) Close() error {
+	if err := o.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(o.File.Name(), o.name)
+}
+
+// commitOutputs puts the (complete) output files in place
+func commitOutputs() {
+	for i, out := range outputs {
+		if err := out.Close(); err != nil {
+			outputs = outputs[i:]
+			fatal("Failed to write output:", err)
+		}
+	}
+	outputs = nil
+}
+
+func doDeduplication(ctx context.Context, in io.Reader, out io.Writer) {
+	opts := optionsFromFlags()
+	var tracker dedup.Tracker = dedup.NewSegmentTracker()
+	if *indexCache > 0 {
+		diskTracker, err := dedup.NewDiskTracker(*spillDir, *indexCache)
+		if err != nil {
+			fatal("Failed to setup segment index:", err)
+		}
+		tracker = diskTracker
+	}
+	defer tracker.Close()
+
+	dedup, err := dedup.NewDeduplicatorWithTracker(opts, tracker)
+	if err != nil {
+		tracker.Close() // fatal skips the deferred Close
+		fatal("Failed to setup deduplicator:", err)
+	}
+	var bar *progressBar
+	if *showProgress {
+		bar = newProgressBar(in)
+		dedup.SetProgress(bar.update)
+	}
+	err = dedup.DoContext(ctx, in, out)
+	if bar != nil {
+		bar.done()
+	}
+	if err != nil {
+		tracker.Close()
+		fatal("Failed to deduplicate:", err)
 	}
 	if *quiet == false {
 		dedup.PrintStats(os.Stderr)
 	}
 }
 
-func doReduplication(in io.Reader, out io.Writer) {
-	redup := dedup.NewReduplicator()
-	if err := redup.Do(in, out); err != nil {
-		log.Fatalln("Failed to reduplicate:", err)
+// optionsFromFlags returns the Deduplicator options described by the cmdline
+// flags
+func optionsFromFlags() dedup.Options {
+	kind, err := codec.ParseKind(*codecName)
+	if err != nil {
+		fatal("Failed to setup codec:", err)
+	}
+	return dedup.Options{
+		Segmenter:   segmenterFromFlags(),
+		Codec:       kind,
+		Workers:     *workers,
+		Checksums:   *checksums,
+		LRUSegments: *lruSegments,
+		LRUBytes:    int64(*lruBytes),
+	}
+}
+
+// segmenterFromFlags returns the Segmenter described by the cmdline flags
+func segmenterFromFlags() dedup.Segmenter {
+	algo, err := dedup.ParseAlgorithm(*chunker)
+	if err != nil {
+		fatal("Failed to setup chunker:", err)
+	}
+
+	seg := dedup.Segmenter{
+		WindowSize:       *windowSize,
+		MinSegmentLength: *minSegment,
+		AvgSegmentLength: *avgSegment,
+		MaxSegmentLength: *maxSegment,
+		Algorithm:        algo,
+	}
+	if *avgSegment == 0 {
+		seg.Mask = uint64((1 << *zeroBits) - 1)
+	}
+	if err := seg.Validate(); err != nil {
+		fatal("Invalid segment params:", err)
+	}
+	return seg
+}
+
+// flagsSetByUser returns the names of the flags given on the cmdline (rather
+// than left at their defaults)
+func flagsSetByUser() map[string]bool {
+	set := map[string]bool{}
+	parsed, err := kingpin.CommandLine.ParseContext(os.Args[1:])
+	if err != nil {
+		return set
+	}
+	for _, elem := range parsed.Elements {
+		if flag, ok := elem.Clause.(*kingpin.FlagClause); ok {
+			set[flag.Model().Name] = true
+		}
+	}
+	return set
+}
+
+// reduplicatorFromFlags returns a Reduplicator honouring the memory flags
+func reduplicatorFromFlags() *dedup.Reduplicator {
+	if *maxMemory > 0 {
+		return dedup.NewReduplicatorWithBudget(int64(*maxMemory), *spillDir)
+	}
+	return dedup.NewReduplicator()
+}
+
+func doReduplication(ctx context.Context, in io.Reader, out io.Writer) {
+	redup := reduplicatorFromFlags()
+	defer redup.Close()
+	var bar *progressBar
+	if *showProgress {
+		bar = newProgressBar(in)
+		redup.SetProgress(bar.update)
+	}
+	err := redup.DoContext(ctx, in, out)
+	if bar != nil {
+		bar.done()
+	}
+	if err != nil {
+		redup.Close() // fatal skips the deferred Close
+		fatal("Failed to reduplicate:", err)
 	}
 	if *quiet == false {
-		// redup.PrintStats()
+		redup.PrintStats(os.Stderr)
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/amoghe/dedup"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// progressBar renders dedup.Progress updates as a single (redrawn) line on
+// stderr. It shows the percentage done and ETA if the size of the input is
+// known (i.e. it is a regular file), and the throughput otherwise.
+type progressBar struct {
+	total  uint64 // size of the input, 0 if unknown
+	start  time.Time
+	drawn  time.Time
+	latest dedup.Progress
+}
+
+func newProgressBar(input io.Reader) *progressBar {
+	bar := &progressBar{start: time.Now()}
+	if file, ok := input.(*os.File); ok {
+		if stat, err := file.Stat(); err == nil && stat.Mode().IsRegular() {
+			bar.total = uint64(stat.Size())
+		}
+	}
+	return bar
+}
+
+// update records the progress, redrawing the line if it is due
+func (p *progressBar) update(progress dedup.Progress) {
+	p.latest = progress
+	if now := time.Now(); now.Sub(p.drawn) >= progressInterval {
+		p.drawn = now
+		p.draw(now)
+	}
+}
+
+// done draws the final progress and ends the line
+func (p *progressBar) done() {
+	p.draw(time.Now())
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressBar) draw(now time.Time) {
+	var (
+		elapsed = now.Sub(p.start).Seconds()
+		in      = p.latest.BytesIn
+		rate    = 0.0
+	)
+	if elapsed > 0 {
+		rate = float64(in) / elapsed
+	}
+
+	line := fmt.Sprintf("%s -> %s  %s/s  dup %.1f%%",
+		humanBytes(float64(in)), humanBytes(float64(p.latest.BytesOut)),
+		humanBytes(rate), 100*p.latest.DupRatio())
+	if p.total > 0 {
+		eta := "--:--"
+		if rate > 0 && in <= p.total {
+			eta = formatDuration(time.Duration(float64(p.total-in) / rate * float64(time.Second)))
+		}
+		line = fmt.Sprintf("%5.1f%%  %s  ETA %s", 100*float64(in)/float64(p.total), line, eta)
+	}
+	// pad to clear whatever was left over from a longer previous line
+	fmt.Fprintf(os.Stderr, "\r%-72s", line)
+}
+
+// humanBytes formats n bytes using binary units (e.g. 1.5 MB)
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// formatDuration formats d as [h:]mm:ss
+func formatDuration(d time.Duration) string {
+	secs := int(d.Seconds() + 0.5)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%02d:%02d", secs/60, secs%60)
+}
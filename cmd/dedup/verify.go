@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	verifyCmd  = kingpin.Command("verify", "Check a dedup stream can be reduplicated (without writing the output)")
+	verifyFile = verifyCmd.Arg("file", "Dedup stream (reads stdin if omitted)").
+			File()
+	verifyUnchecked = verifyCmd.Flag("allow-no-checksum", "Only warn if the stream has no checksums (e.g. written with --no-checksum)").
+			Bool()
+)
+
+// doVerify reduplicates the specified dedup stream, discarding the output. The
+// header, the checksums and the refs are checked, any problem is fatal. So is
+// a stream without checksums (whose contents can't be verified), unless
+// --allow-no-checksum is given.
+func doVerify(ctx context.Context) {
+	input := os.Stdin
+	if *verifyFile != nil {
+		input = *verifyFile
+		defer input.Close()
+	}
+
+	redup := reduplicatorFromFlags()
+	defer redup.Close()
+	if err := redup.DoContext(ctx, input, ioutil.Discard); err != nil {
+		redup.Close() // log.Fatalln skips the deferred Close
+		log.Fatalln("Verification failed:", err)
+	}
+	if *quiet == false {
+		redup.PrintStats(os.Stderr)
+	}
+	if !redup.Checksummed() {
+		if *verifyUnchecked == false {
+			redup.Close()
+			log.Fatalln("Verification failed: stream has no checksums, only its refs were checked")
+		}
+		log.Println("Warning: stream has no checksums, only its refs were checked")
+	}
+}
@@ -15,6 +15,15 @@ const (
 	MessageRef = 1
 	// MessageDef indicates this is a Def message
 	MessageDef = 2
+	// MessageForget indicates this is a Forget message (the segment with RefID
+	// will not be referenced again, so the reader may drop it)
+	MessageForget = 3
+	// MessageTrailer indicates this is a Trailer message (the last message in a
+	// stream written with FlagChecksums, it describes the reassembled output)
+	MessageTrailer = 4
+	// MessageCopy indicates this is a Copy message (the Length bytes at Offset
+	// in the base file the patch applies to, see FlagCopy)
+	MessageCopy = 5
 )
 
 // Message is the message that we write to the output stream
@@ -23,4 +32,11 @@ type Message struct {
 	RefID    uint64
 	DefID    uint64
 	DefBytes []byte
+	Checksum uint32 // CRC32C of DefBytes (Def, with FlagChecksums)
+
+	Offset uint64 // offset in the base file (Copy)
+	Length uint64 // number of bytes to copy from the base file (Copy)
+
+	TotalBytes uint64 // length of the reassembled output (Trailer)
+	Digest     []byte // SHA-512 of the reassembled output (Trailer)
 }
@@ -0,0 +1,154 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var kinds = []Kind{KindGob, KindBinary, KindProtobuf}
+
+// testMessages has a message of every type (with large IDs, to exercise the
+// varints)
+var testMessages = []Message{
+	{Type: MessageDef, DefID: 1, DefBytes: []byte("segment one"), Checksum: 0xdeadbeef},
+	{Type: MessageRef, RefID: 1},
+	{Type: MessageDef, DefID: 1 << 40, DefBytes: bytes.Repeat([]byte{0xa5}, 70000), Checksum: 1},
+	{Type: MessageRef, RefID: 1 << 40},
+	{Type: MessageForget, RefID: 1},
+	{Type: MessageCopy, Offset: 1 << 33, Length: 12345},
+	{Type: MessageCopy, Offset: 0, Length: 1},
+	{Type: MessageTrailer, TotalBytes: 70011 + 12346, Digest: bytes.Repeat([]byte{0x3c}, 64)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, kind := range kinds {
+		t.Run(kind.String(), func(t *testing.T) {
+			buf := bytes.Buffer{}
+			writer, err := NewWriter(kind, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range testMessages {
+				if err := writer.Write(&testMessages[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reader, err := NewReader(kind, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range testMessages {
+				got, err := reader.Read()
+				if err != nil {
+					t.Fatalf("Message %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("Message %d: got %+v, expected %+v", i, got, want)
+				}
+			}
+			if msg, err := reader.Read(); err != io.EOF {
+				t.Fatalf("Expected io.EOF after the last message, got %+v (err %v)", msg, err)
+			}
+		})
+	}
+}
+
+func TestBinaryUnknownMessageType(t *testing.T) {
+	if err := NewBinaryWriter(&bytes.Buffer{}).Write(&Message{Type: 99}); err == nil {
+		t.Fatalf("Expected an error for an unknown message type")
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	headers := []Header{
+		{Version: Version, Codec: KindBinary, Hash: HashSHA512, Flags: FlagChecksums | FlagForget,
+			Chunker: 1, WindowSize: 64, Mask: 8191, MinSegmentLength: 2048, AvgSegmentLength: 8192,
+			MaxSegmentLength: 65536, LRUSegments: 1000},
+		{Version: Version, Codec: KindGob, Hash: HashSHA512, Flags: FlagChecksums | FlagForget | FlagPatch,
+			WindowSize: 48, Mask: 4095, LRUBytes: 1 << 30, BaseSize: 77, BaseDigest: []byte{1, 2, 3}, BaseIDs: 5},
+		{Version: Version, Codec: KindProtobuf, Hash: HashSHA512, Flags: FlagChecksums | FlagPatch | FlagCopy,
+			WindowSize: 48, Mask: 4095, MinSegmentLength: 48, AvgSegmentLength: 4096, MaxSegmentLength: 32768,
+			BaseSize: 1 << 35, BaseDigest: bytes.Repeat([]byte{7}, 64), BaseIDs: 123456},
+		{Version: Version, Codec: KindGob, Hash: HashSHA512, Flags: FlagSignature,
+			BaseDigest: []byte{}},
+	}
+	for i, want := range headers {
+		buf := bytes.Buffer{}
+		if err := WriteHeader(&buf, want); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("rest")
+
+		input := bufio.NewReader(&buf)
+		got, err := ReadHeader(input)
+		if err != nil {
+			t.Fatalf("Header %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Header %d: got %+v, expected %+v", i, got, want)
+		}
+		if rest, _ := ioutil.ReadAll(input); string(rest) != "rest" {
+			t.Fatalf("Header %d: read too much (or too little), %q is left", i, rest)
+		}
+	}
+}
+
+func TestReadLegacyHeaders(t *testing.T) {
+	// version 0 streams have no header
+	got, err := ReadHeader(bufio.NewReader(bytes.NewReader([]byte{0x0d, 0xff})))
+	if err != nil || got.Version != 0 || got.Codec != KindGob {
+		t.Fatalf("Got %+v (err %v) for a version 0 stream", got, err)
+	}
+	_, err = ReadHeader(bufio.NewReader(bytes.NewReader(append(append([]byte{}, Magic...), Version+1))))
+	if err == nil {
+		t.Fatalf("Expected an error for a stream from the future")
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct{ count int64 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
+}
+
+// benchmarkWriter writes a mix of (8KiB) Defs and Refs, and reports the bytes
+// written per record
+func benchmarkWriter(b *testing.B, kind Kind) {
+	var (
+		output = &countingWriter{}
+		def    = Message{Type: MessageDef, DefBytes: bytes.Repeat([]byte{0x42}, 8192), Checksum: 42}
+		ref    = Message{Type: MessageRef}
+	)
+	writer, err := NewWriter(kind, output)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := &ref
+		if i%4 == 0 {
+			def.DefID = uint64(i + 1)
+			msg = &def
+		} else {
+			ref.RefID = uint64(i/4*4 + 1)
+		}
+		if err := writer.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(output.count / int64(b.N))
+	b.ReportMetric(float64(output.count)/float64(b.N), "bytes/record")
+}
+
+func BenchmarkGobWriter(b *testing.B)    { benchmarkWriter(b, KindGob) }
+func BenchmarkBinaryWriter(b *testing.B) { benchmarkWriter(b, KindBinary) }
+func BenchmarkProtoWriter(b *testing.B)  { benchmarkWriter(b, KindProtobuf) }
@@ -0,0 +1,244 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Magic is written at the start of every dedup stream
+var Magic = []byte("DDUP")
+
+// Version is the current version of the stream format. Streams written before
+// the header was introduced (bare gob streams) are treated as version 0.
+const Version = 1
+
+// Kind identifies the encoding used for the messages in a stream
+type Kind uint8
+
+const (
+	// KindGob indicates messages are encoded using golang/gob
+	KindGob Kind = 1
+	// KindBinary indicates messages are encoded by the BinaryWriter
+	KindBinary Kind = 2
+	// KindProtobuf indicates messages are encoded as protobufs (dedup.proto)
+	KindProtobuf Kind = 3
+)
+
+var kindNames = map[Kind]string{
+	KindGob:      "gob",
+	KindBinary:   "binary",
+	KindProtobuf: "protobuf",
+}
+
+// ParseKind returns the Kind with the given name
+func ParseKind(name string) (Kind, error) {
+	for kind, n := range kindNames {
+		if n == name {
+			return kind, nil
+		}
+	}
+	return 0, errors.Errorf("Unknown codec: %s", name)
+}
+
+// String returns the name of the codec kind
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// HashSHA512 indicates segments are identified by their SHA-512 hash
+const HashSHA512 = 1
+
+const (
+	// FlagForget indicates the stream may contain Forget messages
+	FlagForget = 1 << iota
+	// FlagChecksums indicates Defs carry a checksum and the stream ends with a
+	// Trailer message
+	FlagChecksums
+	// FlagPatch indicates the stream is a patch, the header then describes the
+	// base (old) file it applies to
+	FlagPatch
+	// FlagCopy indicates the (patch) stream may contain Copy messages, which
+	// refer to ranges of the base file
+	FlagCopy
+	// FlagSignature indicates the header is that of a signature (a list of the
+	// segments of the base file it describes) rather than a dedup stream
+	FlagSignature
+
+	knownFlags = FlagForget | FlagChecksums | FlagPatch | FlagCopy | FlagSignature
+)
+
+// maxDigestLength bounds the base digest read from a header
+const maxDigestLength = 1024
+
+// Header describes a stream, it is written before any messages
+type Header struct {
+	Version uint8
+	Codec   Kind
+	Hash    uint8 // hash used to identify segments (e.g. HashSHA512)
+	Flags   uint64
+
+	// Params of the chunker that produced the stream
+	Chunker          uint8 // chunking algorithm
+	WindowSize       uint64
+	Mask             uint64
+	MinSegmentLength uint64
+	AvgSegmentLength uint64
+	MaxSegmentLength uint64
+
+	// Bounds of the LRU window the stream was written with (FlagForget only)
+	LRUSegments uint64
+	LRUBytes    uint64
+
+	// Base file a patch applies to (or a signature describes)
+	BaseSize   uint64
+	BaseDigest []byte // SHA-512 of the base file
+	BaseIDs    uint64 // segment IDs used by the base file (1 to BaseIDs)
+}
+
+// HasBase returns whether the header describes a base file (i.e. it is that of
+// a patch or a signature)
+func (h Header) HasBase() bool {
+	return h.Flags&(FlagPatch|FlagSignature) != 0
+}
+
+// WriteHeader writes the header to the output stream. The header is laid out
+// as the magic bytes, followed by the version, codec, hash and chunker bytes,
+// followed by the flags and chunker params as uvarints. Streams with FlagForget
+// then have the bounds of the LRU window (uvarints), and patches and signatures
+// the base size and the length of the base digest (uvarints) followed by the
+// digest and the number of base IDs (uvarint).
+func WriteHeader(output io.Writer, h Header) error {
+	buf := bytes.Buffer{}
+	buf.Write(Magic)
+	buf.Write([]byte{h.Version, byte(h.Codec), h.Hash, h.Chunker})
+
+	var v [binary.MaxVarintLen64]byte
+	for _, val := range []uint64{h.Flags, h.WindowSize, h.Mask,
+		h.MinSegmentLength, h.AvgSegmentLength, h.MaxSegmentLength} {
+		buf.Write(v[:binary.PutUvarint(v[:], val)])
+	}
+	if h.Flags&FlagForget != 0 {
+		buf.Write(v[:binary.PutUvarint(v[:], h.LRUSegments)])
+		buf.Write(v[:binary.PutUvarint(v[:], h.LRUBytes)])
+	}
+	if h.HasBase() {
+		buf.Write(v[:binary.PutUvarint(v[:], h.BaseSize)])
+		buf.Write(v[:binary.PutUvarint(v[:], uint64(len(h.BaseDigest)))])
+		buf.Write(h.BaseDigest)
+		buf.Write(v[:binary.PutUvarint(v[:], h.BaseIDs)])
+	}
+
+	if _, err := output.Write(buf.Bytes()); err != nil {
+		return errors.Wrapf(err, "Failed to write header")
+	}
+	return nil
+}
+
+// ReadHeader reads the header from the start of the input stream. If the input
+// does not start with the magic bytes it is assumed to be a version 0 (gob)
+// stream, and nothing is consumed.
+func ReadHeader(input *bufio.Reader) (Header, error) {
+	magic, err := input.Peek(len(Magic))
+	if err != nil && err != io.EOF {
+		return Header{}, errors.Wrapf(err, "Failed to read header")
+	}
+	if !bytes.Equal(magic, Magic) {
+		return Header{Version: 0, Codec: KindGob, Hash: HashSHA512}, nil
+	}
+	input.Discard(len(Magic))
+
+	version, err := input.ReadByte()
+	if err != nil {
+		return Header{}, errors.Wrapf(err, "Failed to read header")
+	}
+	h := Header{Version: version, Codec: KindGob, Hash: HashSHA512}
+	if h.Version == 0 || h.Version > Version {
+		return h, errors.Errorf("Unsupported stream version %d (this build supports up to %d)",
+			h.Version, Version)
+	}
+	var fixed [3]byte
+	if _, err := io.ReadFull(input, fixed[:]); err != nil {
+		return Header{}, errors.Wrapf(err, "Failed to read header")
+	}
+	h.Codec, h.Hash, h.Chunker = Kind(fixed[0]), fixed[1], fixed[2]
+	if _, ok := kindNames[h.Codec]; !ok {
+		return h, errors.Errorf("Unsupported codec in stream: %d", h.Codec)
+	}
+	if h.Hash != HashSHA512 {
+		return h, errors.Errorf("Unsupported hash in stream: %d", h.Hash)
+	}
+
+	for _, val := range []*uint64{&h.Flags, &h.WindowSize, &h.Mask,
+		&h.MinSegmentLength, &h.AvgSegmentLength, &h.MaxSegmentLength} {
+		if *val, err = binary.ReadUvarint(input); err != nil {
+			return h, errors.Wrapf(err, "Failed to read header")
+		}
+	}
+	if h.Flags&^knownFlags != 0 {
+		return h, errors.Errorf("Unsupported flags in stream: %#x", h.Flags)
+	}
+
+	if h.Flags&FlagForget != 0 {
+		for _, val := range []*uint64{&h.LRUSegments, &h.LRUBytes} {
+			if *val, err = binary.ReadUvarint(input); err != nil {
+				return h, errors.Wrapf(err, "Failed to read header")
+			}
+		}
+	}
+
+	if h.HasBase() {
+		if h.BaseSize, err = binary.ReadUvarint(input); err != nil {
+			return h, errors.Wrapf(err, "Failed to read header")
+		}
+		length, err := binary.ReadUvarint(input)
+		if err != nil {
+			return h, errors.Wrapf(err, "Failed to read header")
+		}
+		if length > maxDigestLength {
+			return h, errors.Errorf("Invalid base digest length in header: %d", length)
+		}
+		h.BaseDigest = make([]byte, length)
+		if _, err := io.ReadFull(input, h.BaseDigest); err != nil {
+			return h, errors.Wrapf(err, "Failed to read header")
+		}
+		if h.BaseIDs, err = binary.ReadUvarint(input); err != nil {
+			return h, errors.Wrapf(err, "Failed to read header")
+		}
+	}
+	return h, nil
+}
+
+// NewWriter returns a Writer that encodes messages of the given kind
+func NewWriter(kind Kind, output io.Writer) (Writer, error) {
+	switch kind {
+	case KindGob:
+		return NewGobWriter(output), nil
+	case KindBinary:
+		return NewBinaryWriter(output), nil
+	case KindProtobuf:
+		return NewProtoWriter(output), nil
+	default:
+		return nil, errors.Errorf("Unsupported codec: %d", kind)
+	}
+}
+
+// NewReader returns a Reader that decodes messages of the given kind
+func NewReader(kind Kind, input io.Reader) (Reader, error) {
+	switch kind {
+	case KindGob:
+		return NewGobReader(input), nil
+	case KindBinary:
+		return NewBinaryReader(input), nil
+	case KindProtobuf:
+		return NewProtoReader(input), nil
+	default:
+		return nil, errors.Errorf("Unsupported codec: %d", kind)
+	}
+}
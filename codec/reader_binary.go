@@ -0,0 +1,59 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// BinaryReader allows us to read streams written by a BinaryWriter
+type BinaryReader struct {
+	reader *DelimitedReader
+}
+
+// NewBinaryReader returns a codec.Reader capable of reading binary encoded
+// messages from input streams
+func NewBinaryReader(input io.Reader) Reader {
+	return &BinaryReader{reader: NewDelimitedReader(input)}
+}
+
+// Read returns the next message available in the input stream
+func (r *BinaryReader) Read() (Message, error) {
+	rec, err := r.reader.Next()
+	if err != nil {
+		return Message{}, err
+	}
+	if len(rec) == 0 {
+		return Message{}, errors.Errorf("Failed to decode msg: empty record")
+	}
+
+	msg := Message{Type: uint16(rec[0])}
+	id, n := binary.Uvarint(rec[1:])
+	if n <= 0 {
+		return msg, errors.Errorf("Failed to decode msg: bad ID")
+	}
+
+	switch msg.Type {
+	case MessageDef:
+		if len(rec) < 1+n+4 {
+			return msg, errors.Errorf("Failed to decode msg: short Def")
+		}
+		msg.DefID = id
+		msg.Checksum = binary.LittleEndian.Uint32(rec[1+n:])
+		// the record is only valid till the next read, so copy the segment
+		msg.DefBytes = append([]byte{}, rec[1+n+4:]...)
+	case MessageRef, MessageForget:
+		msg.RefID = id
+	case MessageTrailer:
+		msg.TotalBytes = id
+		msg.Digest = append([]byte{}, rec[1+n:]...)
+	case MessageCopy:
+		length, m := binary.Uvarint(rec[1+n:])
+		if m <= 0 {
+			return msg, errors.Errorf("Failed to decode msg: bad Copy length")
+		}
+		msg.Offset, msg.Length = id, length
+	}
+	return msg, nil
+}
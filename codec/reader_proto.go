@@ -0,0 +1,35 @@
+package codec
+
+import (
+	"io"
+)
+
+// ProtoReader allows us to read streams of length-delimited protobuf Records
+type ProtoReader struct {
+	reader *DelimitedReader
+}
+
+// NewProtoReader returns a codec.Reader capable of reading protobuf encoded
+// messages from input streams
+func NewProtoReader(input io.Reader) Reader {
+	return &ProtoReader{reader: NewDelimitedReader(input)}
+}
+
+// Read returns the next message available in the input stream
+func (r *ProtoReader) Read() (Message, error) {
+	rec := Record{}
+	if err := r.reader.NextProto(&rec); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:       uint16(rec.Type),
+		RefID:      rec.RefId,
+		DefID:      rec.DefId,
+		DefBytes:   rec.DefBytes,
+		Checksum:   rec.Checksum,
+		TotalBytes: rec.TotalBytes,
+		Digest:     rec.Digest,
+		Offset:     rec.Offset,
+		Length:     rec.Length,
+	}, nil
+}
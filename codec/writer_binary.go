@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// BinaryWriter implements Writer. It writes messages in a compact binary form
+// as length-delimited records, each being the message type (1 byte) followed
+// by the uvarint ID and (for Defs) the checksum (4 bytes, little endian) and
+// the raw segment bytes. Trailers carry the uvarint total length followed by
+// the digest, and Copies the uvarint offset and length.
+type BinaryWriter struct {
+	output io.Writer
+	rec    []byte       // message being encoded
+	buf    bytes.Buffer // delimited record being written
+	writer *DelimitedWriter
+}
+
+// NewBinaryWriter returns a codec.Writer capable of emitting binary encoded
+// messages to the specified output
+func NewBinaryWriter(output io.Writer) Writer {
+	w := &BinaryWriter{output: output}
+	w.writer = NewDelimitedWriter(&w.buf)
+	return w
+}
+
+// Write emits the message to the output stream
+func (w *BinaryWriter) Write(msg *Message) error {
+	var id [binary.MaxVarintLen64]byte
+	var sum [4]byte
+
+	w.rec = append(w.rec[:0], byte(msg.Type))
+	switch msg.Type {
+	case MessageDef:
+		binary.LittleEndian.PutUint32(sum[:], msg.Checksum)
+		w.rec = append(w.rec, id[:binary.PutUvarint(id[:], msg.DefID)]...)
+		w.rec = append(w.rec, sum[:]...)
+		w.rec = append(w.rec, msg.DefBytes...)
+	case MessageRef, MessageForget:
+		w.rec = append(w.rec, id[:binary.PutUvarint(id[:], msg.RefID)]...)
+	case MessageTrailer:
+		w.rec = append(w.rec, id[:binary.PutUvarint(id[:], msg.TotalBytes)]...)
+		w.rec = append(w.rec, msg.Digest...)
+	case MessageCopy:
+		w.rec = append(w.rec, id[:binary.PutUvarint(id[:], msg.Offset)]...)
+		w.rec = append(w.rec, id[:binary.PutUvarint(id[:], msg.Length)]...)
+	default:
+		return errors.Errorf("Failed to encode msg: unknown type %d", msg.Type)
+	}
+
+	// build the whole delimited record so that it goes out in a single write
+	w.buf.Reset()
+	if err := w.writer.Put(w.rec); err != nil {
+		return errors.Wrapf(err, "Failed to encode msg")
+	}
+	if _, err := w.output.Write(w.buf.Bytes()); err != nil {
+		return errors.Wrapf(err, "Failed to write msg")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative dedup.proto
+
+// ProtoWriter implements Writer. It writes messages as length-delimited
+// protobuf Records (see dedup.proto)
+type ProtoWriter struct {
+	output io.Writer
+	buf    bytes.Buffer // delimited record being written
+	writer *DelimitedWriter
+}
+
+// NewProtoWriter returns a codec.Writer capable of emitting protobuf encoded
+// messages to the specified output
+func NewProtoWriter(output io.Writer) Writer {
+	w := &ProtoWriter{output: output}
+	w.writer = NewDelimitedWriter(&w.buf)
+	return w
+}
+
+// Write emits the message to the output stream
+func (w *ProtoWriter) Write(msg *Message) error {
+	rec := Record{
+		Type:       Record_Type(msg.Type),
+		RefId:      msg.RefID,
+		DefId:      msg.DefID,
+		DefBytes:   msg.DefBytes,
+		Checksum:   msg.Checksum,
+		TotalBytes: msg.TotalBytes,
+		Digest:     msg.Digest,
+		Offset:     msg.Offset,
+		Length:     msg.Length,
+	}
+
+	// build the whole delimited record so that it goes out in a single write
+	w.buf.Reset()
+	if err := w.writer.PutProto(&rec); err != nil {
+		return errors.Wrapf(err, "Failed to encode msg")
+	}
+	if _, err := w.output.Write(w.buf.Bytes()); err != nil {
+		return errors.Wrapf(err, "Failed to write msg")
+	}
+	return nil
+}
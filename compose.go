@@ -0,0 +1,280 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+// ComposePatches writes a patch that is equivalent to applying the first patch
+// and then the second (e.g. given v1->v2 and v2->v3 patches, it writes a v1->v3
+// patch) to out, without recreating the intermediate file. Both patches must
+// have been made by MakePatch with the same segmenter options. Only the Defs
+// of the first patch are held (in memory) while composing.
+func ComposePatches(first, second io.Reader, out io.Writer) error {
+	return ComposePatchesContext(context.Background(), first, second, out)
+}
+
+// ComposePatchesContext is ComposePatches, but gives up (returning ctx.Err())
+// between records once ctx is done
+func ComposePatchesContext(ctx context.Context, first, second io.Reader, out io.Writer) error {
+	h1, r1, err := openStream(first)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read first patch")
+	}
+	if err := checkComposable(h1); err != nil {
+		return errors.Wrapf(err, "Can't compose first patch")
+	}
+	mid, err := loadPatch(ctx, h1, r1)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read first patch")
+	}
+	defer mid.defs.Close()
+
+	h2, r2, err := openStream(second)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read second patch")
+	}
+	if err := checkComposable(h2); err != nil {
+		return errors.Wrapf(err, "Can't compose second patch")
+	}
+	if !sameChunker(h1, h2) {
+		return errors.Errorf("Patches were made with different chunker params")
+	}
+	if h2.BaseSize != mid.trailer.TotalBytes || !bytes.Equal(h2.BaseDigest, mid.trailer.Digest) ||
+		h2.BaseIDs != uint64(len(mid.ids)) {
+		return errors.Errorf("Second patch does not apply to the output of the first")
+	}
+
+	// the composed patch applies to the base of the first patch
+	writer, err := codec.NewWriter(h1.Codec, out)
+	if err != nil {
+		return err
+	}
+	if err := codec.WriteHeader(out, h1); err != nil {
+		return err
+	}
+
+	// IDs of segments defined by the second patch are moved past the IDs used
+	// by the first
+	var (
+		check   = newVerifier() // only for the Def checksums of the second patch
+		emitted = map[uint64]bool{}
+		moved   = func(id uint64) uint64 { return mid.lastID + id - h2.BaseIDs }
+		trailed = false
+	)
+	for record := uint64(0); ; record++ {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		msg, err := r2.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "Failed to read second patch")
+		}
+
+		out := msg
+		switch msg.Type {
+		case codec.MessageDef:
+			if msg.DefID <= h2.BaseIDs {
+				return errors.Errorf("Second patch redefines segment %d of its base (record %d)", msg.DefID, record)
+			}
+			if err := check.check(&msg); err != nil {
+				return err
+			}
+			out.DefID = moved(msg.DefID)
+		case codec.MessageRef:
+			if msg.RefID > h2.BaseIDs {
+				out.RefID = moved(msg.RefID)
+				break
+			}
+			if msg.RefID == 0 {
+				return &UnknownRefError{ID: msg.RefID, Record: record}
+			}
+			// a segment of the intermediate file, refer to it as the first
+			// patch does (defining it, the first time, if the first patch did)
+			id := mid.ids[msg.RefID-1]
+			out.RefID = id
+			if id > h1.BaseIDs && !emitted[id] {
+				seg, there, err := mid.defs.Get(id)
+				if err != nil {
+					return err
+				}
+				if !there {
+					return &UnknownRefError{ID: msg.RefID, Record: record}
+				}
+				out = codec.Message{
+					Type:     codec.MessageDef,
+					DefID:    id,
+					DefBytes: seg,
+					Checksum: crc32.Checksum(seg, castagnoli),
+				}
+				emitted[id] = true
+			}
+		case codec.MessageTrailer:
+			trailed = true // the output of the composed patch is that of the second
+		default:
+			return errors.Errorf("Unexpected type in second patch: %d", msg.Type)
+		}
+
+		if err := writer.Write(&out); err != nil {
+			return err
+		}
+	}
+	if !trailed {
+		return errors.Errorf("Second patch truncated: no trailer")
+	}
+	return nil
+}
+
+// errChainStopped is how composers of a chain of patches are told to stop
+// early, when what consumes their output has failed
+var errChainStopped = errors.New("Patch chain stopped")
+
+// ApplyPatchChain applies a sequence of patches (e.g. v1->v2, v2->v3, v3->v4)
+// to 'old' in a single pass, composing them on the fly (see ComposePatches)
+func (d *Differ) ApplyPatchChain(old io.Reader, patches []io.Reader, new io.Writer) error {
+	return d.ApplyPatchChainContext(context.Background(), old, patches, new)
+}
+
+// ApplyPatchChainContext is ApplyPatchChain, but gives up (returning
+// ctx.Err()) once ctx is done
+func (d *Differ) ApplyPatchChainContext(ctx context.Context, old io.Reader, patches []io.Reader, new io.Writer) error {
+	if len(patches) == 0 {
+		return errors.Errorf("No patches to apply")
+	}
+
+	// each patch is composed with the composition of those before it
+	var (
+		wg   = sync.WaitGroup{}
+		errs = make([]error, len(patches)-1)
+	)
+	patch := patches[0]
+	for i, next := range patches[1:] {
+		r, w := io.Pipe()
+		wg.Add(1)
+		go func(i int, first, second io.Reader) {
+			defer wg.Done()
+			errs[i] = ComposePatchesContext(ctx, first, second, w)
+			w.CloseWithError(errs[i])
+			// unblock the composer feeding us, if we bailed early
+			if pipe, ok := first.(*io.PipeReader); ok {
+				pipe.CloseWithError(errChainStopped)
+			}
+		}(i, patch, next)
+		patch = r
+	}
+
+	err := d.ApplyPatchContext(ctx, old, patch, new)
+	if pipe, ok := patch.(*io.PipeReader); ok {
+		pipe.CloseWithError(errChainStopped)
+	}
+	wg.Wait()
+
+	// report the first patch that failed, rather than how that failure
+	// surfaced through the patches after it
+	for i, composeErr := range errs {
+		if composeErr != nil && errors.Cause(composeErr) != errChainStopped {
+			return contextErr(ctx, errors.Wrapf(composeErr, "Failed to apply patch %d of the chain", i+2))
+		}
+	}
+	return err
+}
+
+// checkComposable returns an error if the patch (described by header) can't be
+// composed with others
+func checkComposable(header codec.Header) error {
+	switch {
+	case header.Flags&codec.FlagPatch == 0:
+		return errors.Errorf("Not a patch (or a legacy patch that doesn't describe its base)")
+	case header.Flags&codec.FlagChecksums == 0:
+		return errors.Errorf("Patch has no trailer")
+	case header.Flags&codec.FlagCopy != 0:
+		return errors.Errorf("Patch was made from a signature")
+	case header.Flags&codec.FlagForget != 0:
+		return errors.Errorf("Patch forgets segments")
+	}
+	return nil
+}
+
+// sameChunker returns whether the streams described by a and b were segmented
+// with the same chunker params
+func sameChunker(a, b codec.Header) bool {
+	return a.Chunker == b.Chunker &&
+		a.WindowSize == b.WindowSize &&
+		a.Mask == b.Mask &&
+		a.MinSegmentLength == b.MinSegmentLength &&
+		a.AvgSegmentLength == b.AvgSegmentLength &&
+		a.MaxSegmentLength == b.MaxSegmentLength
+}
+
+// loadedPatch is what's needed of a patch to compose another with it
+type loadedPatch struct {
+	ids     []uint64      // ID of each (unique) segment of the output, in the order a Deduplicator would number them
+	defs    SegmentStore  // segments defined by the patch
+	lastID  uint64        // highest ID used by the patch (or its base)
+	trailer codec.Message // describes the output of the patch
+}
+
+// loadPatch reads the patch (described by header), checking its Defs
+func loadPatch(ctx context.Context, header codec.Header, reader codec.Reader) (*loadedPatch, error) {
+	var (
+		patch = &loadedPatch{defs: NewMemoryStore(), lastID: header.BaseIDs}
+		check = newVerifier() // only for the Def checksums
+		seen  = map[uint64]bool{}
+	)
+	for {
+		if err := canceled(ctx); err != nil {
+			patch.defs.Close()
+			return nil, err
+		}
+		msg, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			patch.defs.Close()
+			return nil, err
+		}
+
+		id := msg.RefID
+		switch msg.Type {
+		case codec.MessageDef:
+			if err = check.check(&msg); err == nil {
+				err = patch.defs.Put(msg.DefID, msg.DefBytes)
+			}
+			id = msg.DefID
+			if id > patch.lastID {
+				patch.lastID = id
+			}
+		case codec.MessageRef:
+		case codec.MessageTrailer:
+			patch.trailer = msg
+			continue
+		default:
+			err = errors.Errorf("Unexpected type in patch: %d", msg.Type)
+		}
+		if err != nil {
+			patch.defs.Close()
+			return nil, err
+		}
+
+		// every Def or Ref is a segment of the output, number them as a
+		// Deduplicator would (in order of their first occurrence)
+		if !seen[id] {
+			seen[id] = true
+			patch.ids = append(patch.ids, id)
+		}
+	}
+
+	if patch.trailer.Type != codec.MessageTrailer {
+		patch.defs.Close()
+		return nil, errors.Errorf("Patch truncated: no trailer")
+	}
+	return patch, nil
+}
@@ -0,0 +1,103 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// composePatches returns the composition of the patches
+func composePatches(t *testing.T, first, second []byte) []byte {
+	composed := bytes.Buffer{}
+	if err := ComposePatches(bytes.NewReader(first), bytes.NewReader(second), &composed); err != nil {
+		t.Fatal(err)
+	}
+	return composed.Bytes()
+}
+
+// applyPatchChain applies the chain of patches to old, returning the output
+func applyPatchChain(d *Differ, old []byte, patches ...[]byte) ([]byte, error) {
+	readers := []io.Reader{}
+	for _, patch := range patches {
+		readers = append(readers, bytes.NewReader(patch))
+	}
+	output := bytes.Buffer{}
+	err := d.ApplyPatchChain(bytes.NewReader(old), readers, &output)
+	return output.Bytes(), err
+}
+
+func TestComposePatches(t *testing.T) {
+	var (
+		v       = testVersions(1<<20, 4, 12)
+		s       = testSegmenter(t, AlgorithmBuzhash)
+		d       = testDiffer(t, s)
+		patches = [][]byte{}
+	)
+	for i := 0; i+1 < len(v); i++ {
+		patches = append(patches, makePatch(t, d, v[i], v[i+1]))
+	}
+
+	// (v1->v2 . v2->v3) . v3->v4, and v1->v2 . (v2->v3 . v3->v4)
+	left := composePatches(t, composePatches(t, patches[0], patches[1]), patches[2])
+	applyPatch(t, d, v[0], left, v[3])
+	right := composePatches(t, patches[0], composePatches(t, patches[1], patches[2]))
+	applyPatch(t, d, v[0], right, v[3])
+}
+
+func TestApplyPatchChain(t *testing.T) {
+	var (
+		v       = testVersions(1<<20, 4, 13)
+		s       = testSegmenter(t, AlgorithmFastCDC)
+		d       = testDiffer(t, s)
+		patches = [][]byte{}
+	)
+	for i := 0; i+1 < len(v); i++ {
+		patches = append(patches, makePatch(t, d, v[i], v[i+1]))
+	}
+
+	output, err := applyPatchChain(d, v[0], patches...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, v[3]) {
+		t.Fatalf("Chain output (%d bytes) doesn't match v4 (%d bytes)", len(output), len(v[3]))
+	}
+
+	// patches out of order don't apply to the output of those before them
+	for _, order := range [][]int{{1, 0, 2}, {0, 2, 1}, {0, 1, 1}} {
+		chain := [][]byte{}
+		for _, i := range order {
+			chain = append(chain, patches[i])
+		}
+		if _, err := applyPatchChain(d, v[0], chain...); err == nil {
+			t.Fatalf("Chain of patches %v applied", order)
+		}
+	}
+}
+
+func TestComposeRestoresDroppedSegment(t *testing.T) {
+	// v2 drops a stretch of v1 that v3 brings back
+	var (
+		a, b, c = testInput(300000, 14), testInput(300000, 15), testInput(300000, 16)
+		v1      = concat(a, b, c)
+		v2      = concat(a, c)
+		v3      = concat(a, b, c, testInput(1000, 17))
+		s       = testSegmenter(t, AlgorithmGear)
+		d       = testDiffer(t, s)
+		p12     = makePatch(t, d, v1, v2)
+		p23     = makePatch(t, d, v2, v3)
+	)
+	applyPatch(t, d, v1, composePatches(t, p12, p23), v3)
+
+	output, err := applyPatchChain(d, v1, p12, p23)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, v3) {
+		t.Fatalf("Chain output (%d bytes) doesn't match v3 (%d bytes)", len(output), len(v3))
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,104 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cancelingReader cancels the context once limit bytes have been read from it
+type cancelingReader struct {
+	reader io.Reader
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.limit -= n; r.limit <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+// cancelAfter returns a context, and a reader of data that cancels it once
+// limit bytes have been read
+func cancelAfter(data []byte, limit int) (context.Context, io.Reader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, &cancelingReader{reader: bytes.NewReader(data), limit: limit, cancel: cancel}
+}
+
+// checkCanceled checks that err is context.Canceled, and that the goroutines
+// started since there were running goroutines have all exited
+func checkCanceled(t *testing.T, err error, running int) {
+	t.Helper()
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	// give the goroutines a moment to exit, they needn't be waited for
+	for start := time.Now(); runtime.NumGoroutine() > running; {
+		if time.Since(start) > 5*time.Second {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines still running (%d before):\n%s", runtime.NumGoroutine(),
+				running, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	data := testInput(4*parallelRegionSize, 33)
+	for _, workers := range []int{1, 4} {
+		d, err := NewDeduplicatorWithOptions(Options{
+			Segmenter: testSegmenter(t, AlgorithmFastCDC),
+			Workers:   workers,
+			Checksums: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		running := runtime.NumGoroutine()
+		ctx, input := cancelAfter(data, parallelRegionSize)
+		checkCanceled(t, d.DoContext(ctx, input, ioutil.Discard), running)
+		d.Close()
+	}
+}
+
+func TestPatchCanceled(t *testing.T) {
+	var (
+		v = testVersions(1<<20, 4, 34)
+		s = testSegmenter(t, AlgorithmBuzhash)
+		d = testDiffer(t, s)
+	)
+	patches := [][]byte{}
+	for i := 0; i+1 < len(v); i++ {
+		patches = append(patches, makePatch(t, d, v[i], v[i+1]))
+	}
+
+	running := runtime.NumGoroutine()
+	ctx, new := cancelAfter(v[1], len(v[1])/2)
+	err := testDiffer(t, s).MakePatchContext(ctx, bytes.NewReader(v[0]), new, ioutil.Discard)
+	checkCanceled(t, err, running)
+
+	ctx, old := cancelAfter(v[0], len(v[0])/2)
+	err = d.ApplyPatchContext(ctx, old, bytes.NewReader(patches[0]), ioutil.Discard)
+	checkCanceled(t, err, running)
+
+	ctx, old = cancelAfter(v[0], len(v[0])/2)
+	readers := []io.Reader{}
+	for _, patch := range patches {
+		readers = append(readers, bytes.NewReader(patch))
+	}
+	err = d.ApplyPatchChainContext(ctx, old, readers, ioutil.Discard)
+	checkCanceled(t, err, running)
+
+	ctx, first := cancelAfter(patches[0], len(patches[0])/2)
+	err = ComposePatchesContext(ctx, first, bytes.NewReader(patches[1]), ioutil.Discard)
+	checkCanceled(t, err, running)
+}
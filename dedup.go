@@ -1,27 +1,101 @@
 package dedup
 
 import (
+	"context"
 	"crypto/sha512"
 	"hash"
+	"hash/crc32"
 	"io"
 
 	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
 )
 
 // Deduplicator performs deduplication of the specified file
 type Deduplicator struct {
 	segmenter *Segmenter
-	tracker   *SegmentTracker
+	tracker   Tracker
 	seghasher hash.Hash
+	workers   int
+	window    *segmentWindow // nil unless the LRU window is enabled
+	codec     codec.Kind
+	checksums bool
+	digest    *streamDigest                  // of the input, when checksums are enabled
+	base      *codec.Message                 // trailer of the base file, when writing a patch
+	baseIDs   uint64                         // segment IDs used by the base file, ditto
+	lastID    uint64                         // highest segment ID issued so far
+	sig       signatureIndex                 // base file segments, when patching from a signature
+	tap       func(msg *codec.Message) error // sees every message written, if set
+
+	output     *CountingWriter // output of the current Do
+	progress   Progress
+	onProgress ProgressFunc
+}
+
+// Options holds the parameters used to configure a Deduplicator
+type Options struct {
+	Segmenter Segmenter  // how the input is chunked into segments
+	Workers   int        // goroutines to segment and hash with (<= 1 is serial)
+	Codec     codec.Kind // encoding of the output stream (defaults to gob)
+
+	// Checksums adds a CRC32C to every Def, and a trailer with the length and
+	// digest of the input to the end of the stream, so that the Reduplicator
+	// can detect corruption.
+	Checksums bool
+
+	// LRUSegments and LRUBytes bound the number (and total size) of the most
+	// recently used segments that are remembered. Segments that fall out of
+	// this window are forgotten (and the output stream tells the Reduplicator
+	// to forget them too), so that memory use on both ends stays bounded. If a
+	// forgotten segment recurs it is defined again. 0 means unbounded.
+	LRUSegments int
+	LRUBytes    int64
 }
 
 // NewDeduplicator returns a Deduplicator
 func NewDeduplicator(winsz, mask uint64) *Deduplicator {
+	return newDeduplicator(Options{
+		Segmenter: Segmenter{WindowSize: winsz, Mask: mask},
+	})
+}
+
+// NewDeduplicatorWithOptions returns a Deduplicator configured as per opts, or
+// an error if the options (e.g. segment sizes) are invalid
+func NewDeduplicatorWithOptions(opts Options) (*Deduplicator, error) {
+	segmenter, err := opts.Segmenter.normalize()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid segmenter options")
+	}
+	opts.Segmenter = segmenter
+	return newDeduplicator(opts), nil
+}
+
+// NewDeduplicatorWithTracker returns a Deduplicator configured as per opts
+// that uses the given Tracker (e.g. a DiskTracker) to track segments
+func NewDeduplicatorWithTracker(opts Options, tracker Tracker) (*Deduplicator, error) {
+	d, err := NewDeduplicatorWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	d.tracker = tracker
+	return d, nil
+}
+
+func newDeduplicator(opts Options) *Deduplicator {
+	segmenter := opts.Segmenter
 	d := Deduplicator{
-		//writer:    codec.NewGobWriter(output),
-		segmenter: &Segmenter{WindowSize: winsz, Mask: mask},
+		segmenter: &segmenter,
 		tracker:   NewSegmentTracker(),
 		seghasher: sha512.New(),
+		workers:   opts.Workers,
+		codec:     opts.Codec,
+		checksums: opts.Checksums,
+	}
+	if d.codec == 0 {
+		d.codec = codec.KindGob
+	}
+	if opts.LRUSegments > 0 || opts.LRUBytes > 0 {
+		d.window = newSegmentWindow(opts.LRUSegments, opts.LRUBytes)
 	}
 
 	return &d
@@ -29,23 +103,191 @@ func NewDeduplicator(winsz, mask uint64) *Deduplicator {
 
 // Do runs the deduplication of the specified input stream
 func (d *Deduplicator) Do(input io.Reader, output io.Writer) error {
-	writer := codec.NewGobWriter(output)
-
-	handler := func(seg []byte) error {
-		stat := d.tracker.Track(seg, d.seghasher.Sum(seg))
-		cmsg := codec.Message{}
-		if stat.Freq <= 1 {
-			cmsg = codec.Message{Type: codec.MessageDef, DefID: stat.ID, DefBytes: seg}
-		} else {
-			cmsg = codec.Message{Type: codec.MessageRef, RefID: stat.ID}
+	return d.DoContext(context.Background(), input, output)
+}
+
+// DoContext runs the deduplication of the specified input stream, giving up
+// (returning ctx.Err()) between segments once ctx is done
+func (d *Deduplicator) DoContext(ctx context.Context, input io.Reader, output io.Writer) error {
+	segmenter, err := d.segmenter.normalize()
+	if err != nil {
+		return err
+	}
+
+	d.output = NewCountingWriter(output)
+	d.progress = Progress{}
+	output = d.output
+
+	writer, err := codec.NewWriter(d.codec, output)
+	if err != nil {
+		return err
+	}
+	if err := codec.WriteHeader(output, d.header(segmenter)); err != nil {
+		return err
+	}
+	if d.checksums {
+		d.digest = newStreamDigest()
+	}
+	var coalescer *copyCoalescer
+	if d.sig != nil {
+		coalescer = &copyCoalescer{writer: writer}
+		writer = coalescer
+	}
+	if d.tap != nil {
+		writer = &tapWriter{writer: writer, tap: d.tap}
+	}
+
+	err = d.segment(ctx, input, func(seg, seghash []byte) error {
+		return d.emit(writer, seg, seghash)
+	})
+	if err == nil && coalescer != nil {
+		err = coalescer.flush()
+	}
+	if err == nil && d.checksums {
+		trailer := d.digest.trailer()
+		err = writer.Write(&trailer)
+	}
+	if err != nil {
+		return err
+	}
+	d.report()
+	return nil
+}
+
+// segment segments (and hashes) the input, using the workers if there are
+// any, handing the segments to the handler in order. It gives up (returning
+// ctx.Err()) between segments once ctx is done.
+func (d *Deduplicator) segment(ctx context.Context, input io.Reader, handler hashedSegmentHandler) error {
+	if d.workers > 1 {
+		return d.segmenter.segmentParallel(input, d.workers, func(seg, seghash []byte) error {
+			if err := canceled(ctx); err != nil {
+				return err
+			}
+			return handler(seg, seghash)
+		})
+	}
+
+	return d.segmenter.SegmentFile(input, func(seg []byte) error {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		d.seghasher.Reset()
+		d.seghasher.Write(seg)
+		return handler(seg, d.seghasher.Sum(nil))
+	})
+}
+
+// SetProgress sets the function that is passed the progress made (by Do) after
+// every segment
+func (d *Deduplicator) SetProgress(fn ProgressFunc) {
+	d.onProgress = fn
+}
+
+// report passes the progress made so far to the ProgressFunc (if any)
+func (d *Deduplicator) report() {
+	if d.onProgress != nil {
+		d.progress.BytesOut = d.output.count
+		d.onProgress(d.progress)
+	}
+}
+
+// canceled returns ctx.Err() if ctx is done (without blocking), nil otherwise
+func canceled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// header returns the header describing the streams written by d
+func (d *Deduplicator) header(s Segmenter) codec.Header {
+	h := codec.Header{
+		Version:          codec.Version,
+		Codec:            d.codec,
+		Hash:             codec.HashSHA512,
+		Chunker:          uint8(s.Algorithm),
+		WindowSize:       s.WindowSize,
+		Mask:             s.Mask,
+		MinSegmentLength: s.MinSegmentLength,
+		AvgSegmentLength: s.AvgSegmentLength,
+		MaxSegmentLength: s.MaxSegmentLength,
+	}
+	if d.window != nil {
+		h.Flags |= codec.FlagForget
+		h.LRUSegments = uint64(d.window.maxSegments)
+		h.LRUBytes = uint64(d.window.maxBytes)
+	}
+	if d.checksums {
+		h.Flags |= codec.FlagChecksums
+	}
+	if d.sig != nil {
+		h.Flags |= codec.FlagCopy
+	}
+	if d.base != nil {
+		h.Flags |= codec.FlagPatch
+		h.BaseSize = d.base.TotalBytes
+		h.BaseDigest = d.base.Digest
+		h.BaseIDs = d.baseIDs
+	}
+	return h
+}
+
+// emit tracks the segment and writes the appropriate message (a Def the first
+// time the segment is seen, a Ref after that) to the writer
+func (d *Deduplicator) emit(writer codec.Writer, seg, seghash []byte) error {
+	if d.sig != nil {
+		if known, there := d.sig[string(seghash)]; there {
+			return d.emitCopy(writer, seg, known)
+		}
+	}
+
+	stat, err := d.tracker.Track(seg, seghash)
+	if err != nil {
+		return err
+	}
+	if stat.ID > d.lastID {
+		d.lastID = stat.ID
+	}
+	cmsg := codec.Message{}
+	if stat.Freq <= 1 {
+		cmsg = codec.Message{Type: codec.MessageDef, DefID: stat.ID, DefBytes: seg}
+	} else {
+		cmsg = codec.Message{Type: codec.MessageRef, RefID: stat.ID}
+	}
+	if d.checksums {
+		d.digest.Write(seg)
+		if cmsg.Type == codec.MessageDef {
+			cmsg.Checksum = crc32.Checksum(seg, castagnoli)
+		}
+	}
+	if err := writer.Write(&cmsg); err != nil {
+		return err
+	}
+
+	if d.window != nil {
+		if err := d.forget(writer, d.window.touch(seghash, stat)); err != nil {
+			return err
 		}
-		return writer.Write(&cmsg)
 	}
 
-	return d.segmenter.SegmentFile(input, handler)
+	d.progress.BytesIn += uint64(len(seg))
+	d.progress.Segments++
+	if cmsg.Type == codec.MessageRef {
+		d.progress.DupSegments++
+		d.progress.DupBytes += uint64(len(seg))
+	}
+	d.report()
+	return nil
 }
 
 // PrintStats prints stats to the given writer
 func (d *Deduplicator) PrintStats(out io.Writer) error {
 	return d.tracker.PrintStats(out)
 }
+
+// Close releases the resources (e.g. index files) held by the tracker
+func (d *Deduplicator) Close() error {
+	return d.tracker.Close()
+}
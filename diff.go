@@ -1,10 +1,11 @@
 package dedup
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha512"
 	"hash"
 	"io"
-	"log"
 	"sync"
 
 	"github.com/amoghe/dedup/codec"
@@ -16,6 +17,7 @@ type Differ struct {
 	dedup     *Deduplicator
 	seghasher hash.Hash
 	segmenter Segmenter
+	store     SegmentStore // holds segments of old for reverse patches, if set
 
 	newSegmentNum uint64 // from where we can start issuing new segment IDs
 }
@@ -27,82 +29,248 @@ func (d devnull) Close() error                      { return nil }
 
 // NewDiffer returns a Differ
 func NewDiffer(winsz, mask uint64) *Differ {
+	dedup := NewDeduplicator(winsz, mask)
+	dedup.checksums = true // patches always carry the digests of old and new
 	return &Differ{
-		dedup:     NewDeduplicator(winsz, mask),
+		dedup:     dedup,
 		segmenter: Segmenter{WindowSize: winsz, Mask: mask},
 		seghasher: sha512.New(),
 	}
 }
 
+// NewDifferWithOptions returns a Differ that segments (and encodes patches) as
+// per opts, or an error if the options are invalid. Patches always carry
+// checksums. Patches (and signatures) record the segmenter options they were
+// made with, which are used in place of the Differ's to segment the old file.
+func NewDifferWithOptions(opts Options) (*Differ, error) {
+	opts.Checksums = true
+	dedup, err := NewDeduplicatorWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Differ{
+		dedup:     dedup,
+		segmenter: *dedup.segmenter,
+		seghasher: sha512.New(),
+	}, nil
+}
+
 // MakePatch writes a "patch" file (betweem "old" and "new") to the specified
-// output WriteCloser
+// output WriteCloser. The patch header records the size and digest of "old"
+// (so that it can't be applied to anything else) and the patch ends with a
+// trailer holding the digest of "new".
 func (d *Differ) MakePatch(old, new io.Reader, out io.Writer) error {
+	return d.MakePatchContext(context.Background(), old, new, out)
+}
+
+// MakePatchContext is MakePatch, but gives up (returning ctx.Err()) once ctx
+// is done
+func (d *Differ) MakePatchContext(ctx context.Context, old, new io.Reader, out io.Writer) error {
+	dedup := d.deduplicator(*d.dedup.segmenter)
+	defer dedup.Close()
+	return dedup.makePatch(ctx, old, new, out, nil)
+}
+
+// makePatch writes the patch between old and new (d must not have seen
+// anything else), passing what is written for each of them to rev (if any) so
+// that it can write the reverse patch
+func (d *Deduplicator) makePatch(ctx context.Context, old, new io.Reader, out io.Writer, rev *reverser) error {
+	if rev != nil {
+		d.tap = rev.recordOld
+	}
 
 	// First parse old file and build up the segment state
-	if err := d.dedup.Do(old, devnull{}); err != nil {
-		return errors.Wrapf(err, "Failed to parse old file")
+	if err := d.DoContext(ctx, old, devnull{}); err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to parse old file"))
 	}
 
-	// Now parse the new file (with the state we've built)
-	if err := d.dedup.Do(new, out); err != nil {
-		return errors.Wrapf(err, "Failed to segment new file")
+	// Now parse the new file (with the state we've built), the header of the
+	// patch describes the old file
+	base := d.digest.trailer()
+	d.base, d.baseIDs = &base, d.lastID
+	if rev != nil {
+		d.tap = rev.recordNew
+	}
+	if err := d.DoContext(ctx, new, out); err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to segment new file"))
 	}
 
 	return nil
 }
 
-// ApplyPatch applies the patch file to the 'old' and writes the result to 'new'
+// ApplyPatch applies the patch file to the 'old' and writes the result to 'new'.
+// It fails (without writing anything) if 'old' is not the file the patch was
+// made against, and fails if the result doesn't match the digest in the patch.
+// Patches made from a signature need 'old' to be an io.ReaderAt (e.g. a file).
+// 'old' is segmented with the chunker params recorded in the patch.
 func (d *Differ) ApplyPatch(old, patch io.Reader, new io.Writer) error {
+	return d.ApplyPatchContext(context.Background(), old, patch, new)
+}
+
+// ApplyPatchContext is ApplyPatch, but gives up (returning ctx.Err()) once ctx
+// is done
+func (d *Differ) ApplyPatchContext(ctx context.Context, old, patch io.Reader, new io.Writer) error {
+	header, cpatch, err := openStream(patch)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read patch")
+	}
+	if header.Flags&codec.FlagCopy != 0 {
+		return d.applyCopyPatch(ctx, old, header, cpatch, new)
+	}
+	oldDedup, err := d.deduplicatorFor(header)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid patch")
+	}
+	defer oldDedup.Close()
 
 	r, w := io.Pipe()
 	redup := NewReduplicator()
+	defer redup.Close()
 	wg := sync.WaitGroup{}
 
+	var redupErr error
 	wg.Add(1)
 	go func() {
-		redup.Do(r, devnull{})
+		redupErr = redup.DoContext(ctx, r, devnull{})
+		r.CloseWithError(redupErr) // unblock the dedup if we bailed early
 		wg.Done()
 	}()
 
 	// First parse the 'old' file and build up segment state (in the redup)
-	if err := d.dedup.Do(old, w); err != nil {
-		return errors.Wrapf(err, "Failed to parse old file")
+	err = oldDedup.DoContext(ctx, old, w)
+	w.CloseWithError(err) // close the dummy writer (nil err means EOF)
+	wg.Wait()             // wait for dummy redup to be done
+	if err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to parse old file"))
+	}
+	if redupErr != nil {
+		return contextErr(ctx, errors.Wrapf(redupErr, "Failed to load old file"))
+	}
+	if err := checkBase(header, oldDedup.digest.trailer()); err != nil {
+		return err
 	}
-	w.Close() // close the dummy writer
-	wg.Wait() // wait for dummy redup to be done
 
 	// Next parse the 'patch' file and recreate 'new' using the messages
-	cpatch := codec.NewGobReader(patch)
-
-	handleDef := func(msg *codec.Message) {
-		redup.tracker[msg.DefID] = msg.DefBytes
-		// receipt of def is implicit ref, so output the bytes
-		new.Write(msg.DefBytes)
-	}
-	handleRef := func(msg *codec.Message) {
-		if b, ok := redup.tracker[msg.RefID]; ok {
-			new.Write(b)
-		} else {
-			log.Panicln("Previously unseen Ref", msg.RefID)
-		}
+	return redup.replay(ctx, redup.newDecoder(header, cpatch), new)
+}
+
+// applyCopyPatch applies a patch made from a signature (see
+// MakePatchFromSignature). Its Copy messages are resolved by reading the old
+// file at the given offsets, so old must be an io.ReaderAt.
+func (d *Differ) applyCopyPatch(ctx context.Context, old io.Reader, header codec.Header, cpatch codec.Reader, new io.Writer) error {
+	base, ok := old.(io.ReaderAt)
+	if !ok {
+		return errors.Errorf("Patch was made from a signature, it needs random access to the old file")
+	}
+
+	// make sure this is the right old file before writing anything (reading at
+	// most a byte more than it should have, to tell if it is too long)
+	digest := newStreamDigest()
+	section := io.NewSectionReader(base, 0, int64(header.BaseSize)+1)
+	if _, err := io.Copy(digest, &contextReader{ctx: ctx, reader: section}); err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to read old file"))
+	}
+	if err := checkBase(header, digest.trailer()); err != nil {
+		return err
 	}
-	for {
-		msg, err := cpatch.Read()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
 
-		switch msg.Type {
-		case codec.MessageDef:
-			handleDef(&msg)
-		case codec.MessageRef:
-			handleRef(&msg)
-		default:
-			return errors.Errorf("Unexpected type in input stream: %d", msg.Type)
+	redup := NewReduplicator()
+	defer redup.Close()
+	dec := redup.newDecoder(header, cpatch)
+	dec.base = base
+	return redup.replay(ctx, dec, new)
+}
+
+// contextReader fails reads (with ctx.Err()) once ctx is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := canceled(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// segmenterFor returns the Segmenter that the patch (or signature) described
+// by header was made with, so that the old file is segmented the same way.
+// Legacy headers don't record (all) the chunker params, ours fill in for them.
+func (d *Differ) segmenterFor(header codec.Header) (Segmenter, error) {
+	s := *d.dedup.segmenter
+	if header.Version > 0 { // legacy streams don't record any
+		s.Algorithm = Algorithm(header.Chunker)
+		s.WindowSize = header.WindowSize
+		s.Mask = header.Mask
+		s.MinSegmentLength = header.MinSegmentLength
+		s.AvgSegmentLength = header.AvgSegmentLength
+		s.MaxSegmentLength = header.MaxSegmentLength
+	}
+	s, err := s.normalize()
+	if err != nil {
+		return s, errors.Wrapf(err, "Unusable chunker params (%s, window %d, mask %#x)",
+			Algorithm(header.Chunker), header.WindowSize, header.Mask)
+	}
+	return s, nil
+}
+
+// deduplicatorFor returns a new Deduplicator, configured as ours, that
+// segments as the patch (or signature) described by header was segmented. For
+// a patch, it also forgets segments as the old file's were (the IDs the patch
+// refers to depend on it), whatever our LRU window.
+func (d *Differ) deduplicatorFor(header codec.Header) (*Deduplicator, error) {
+	segmenter, err := d.segmenterFor(header)
+	if err != nil {
+		return nil, err
+	}
+	dedup := d.deduplicator(segmenter)
+	if header.Flags&codec.FlagPatch != 0 {
+		dedup.window = nil
+		if header.Flags&codec.FlagForget != 0 {
+			dedup.window = newSegmentWindow(int(header.LRUSegments), int64(header.LRUBytes))
 		}
+	}
+	return dedup, nil
+}
+
+// deduplicator returns a new Deduplicator, configured as ours but with the
+// given segmenter. Each patch is made (or applied) by a new one, as the IDs in
+// a patch are those a Deduplicator that has seen nothing else would assign.
+func (d *Differ) deduplicator(segmenter Segmenter) *Deduplicator {
+	opts := Options{
+		Segmenter: segmenter,
+		Workers:   d.dedup.workers,
+		Codec:     d.dedup.codec,
+		Checksums: true,
+	}
+	if d.dedup.window != nil {
+		opts.LRUSegments, opts.LRUBytes = d.dedup.window.maxSegments, d.dedup.window.maxBytes
+	}
+	return newDeduplicator(opts)
+}
 
+// checkBase returns an error if the patch (described by header) was not made
+// against the old file described by base (its trailer)
+func checkBase(header codec.Header, base codec.Message) error {
+	if header.Flags&codec.FlagPatch == 0 {
+		return nil // legacy patches don't say what they apply to
+	}
+	if header.BaseSize != base.TotalBytes {
+		return errors.Errorf("Patch does not apply to old file: size is %d, expected %d",
+			base.TotalBytes, header.BaseSize)
+	}
+	if !bytes.Equal(header.BaseDigest, base.Digest) {
+		return errors.Errorf("Patch does not apply to old file: digest mismatch")
 	}
 	return nil
 }
+
+// contextErr returns ctx.Err() if ctx is done (so that callers can compare it
+// against context.Canceled etc), err otherwise
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package dedup
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testVersions returns size bytes of data, followed by n-1 versions of it that
+// each differ from the one before by a few edits
+func testVersions(size, n int, seed int64) [][]byte {
+	versions := [][]byte{testInput(size, seed)}
+	for i := 1; i < n; i++ {
+		prev := versions[i-1]
+		next := append([]byte{}, prev[:size/4]...)
+		next = append(next, testInput(20000, seed+int64(i))...) // insertion
+		next = append(next, prev[size/4:size/2]...)
+		next = append(next, prev[size/2+30000:]...) // deletion
+		next = append(next, testInput(5000, -seed-int64(i))...)
+		versions = append(versions, next)
+	}
+	return versions
+}
+
+// testDiffer returns a Differ with the given segmenter (and otherwise default)
+// options
+func testDiffer(t testing.TB, s Segmenter) *Differ {
+	d, err := NewDifferWithOptions(Options{Segmenter: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// makePatch returns the patch between old and new
+func makePatch(t testing.TB, d *Differ, old, new []byte) []byte {
+	patch := bytes.Buffer{}
+	if err := d.MakePatch(bytes.NewReader(old), bytes.NewReader(new), &patch); err != nil {
+		t.Fatal(err)
+	}
+	return patch.Bytes()
+}
+
+// applyPatch checks that the patch turns old into new
+func applyPatch(t testing.TB, d *Differ, old, patch, new []byte) {
+	output := bytes.Buffer{}
+	if err := d.ApplyPatch(bytes.NewReader(old), bytes.NewReader(patch), &output); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), new) {
+		t.Fatalf("Patched output (%d bytes) doesn't match the new file (%d bytes)", output.Len(), len(new))
+	}
+}
+
+func TestApplyPatchWithPatchChunker(t *testing.T) {
+	var (
+		v     = testVersions(1<<20, 2, 11)
+		plain = testDiffer(t, Segmenter{WindowSize: 48, Mask: 0xffff})
+		fast  = testSegmenter(t, AlgorithmFastCDC)
+		patch = makePatch(t, testDiffer(t, fast), v[0], v[1])
+	)
+	sig, err := testDiffer(t, fast).MakeSignature(bytes.NewReader(v[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old file must be segmented as it was when the patch was made, not as
+	// the applying Differ would segment it
+	applyPatch(t, plain, v[0], patch, v[1])
+
+	// ditto for the new file, when making a patch from a signature
+	fromSig := bytes.Buffer{}
+	if err := plain.MakePatchFromSignature(sig, bytes.NewReader(v[1]), &fromSig); err != nil {
+		t.Fatal(err)
+	}
+	applyPatch(t, plain, v[0], fromSig.Bytes(), v[1])
+	if fromSig.Len() > len(v[1])/4 {
+		t.Fatalf("Patch from signature is %d bytes, the new file only differs by a few edits", fromSig.Len())
+	}
+}
+
+func TestApplyPatchWithLRUWindow(t *testing.T) {
+	// x is forgotten before it repeats in old, so the IDs of the segments of b
+	// (which new refers to) depend on the window old was segmented with
+	var (
+		x, y, b = testInput(200000, 36), testInput(200000, 37), testInput(30000, 38)
+		v       = [][]byte{concat(x, y, x, b), concat(b, testInput(100000, 39))}
+		s       = testSegmenter(t, AlgorithmBuzhash)
+	)
+	windowed, err := NewDifferWithOptions(Options{Segmenter: s, LRUSegments: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := bytes.Buffer{}
+	if err := windowed.MakePatch(bytes.NewReader(v[0]), bytes.NewReader(v[1]), &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old file must forget segments as it did when the patch was made, not
+	// as the applying Differ would
+	other, err := NewDifferWithOptions(Options{Segmenter: s, LRUBytes: 1 << 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*Differ{testDiffer(t, s), other, windowed} {
+		applyPatch(t, d, v[0], patch.Bytes(), v[1])
+	}
+}
+
+func TestDifferReuse(t *testing.T) {
+	var (
+		v = testVersions(1<<20, 3, 43)
+		s = testSegmenter(t, AlgorithmBuzhash)
+		d = testDiffer(t, s)
+	)
+
+	// nothing of the files a Differ has seen must leak into its next patch
+	first, second := makePatch(t, d, v[0], v[1]), makePatch(t, d, v[1], v[2])
+	applyPatch(t, d, v[0], first, v[1])
+	applyPatch(t, d, v[1], second, v[2])
+	if !bytes.Equal(second, makePatch(t, testDiffer(t, s), v[1], v[2])) {
+		t.Fatalf("Second patch differs from the one a new Differ makes")
+	}
+
+	for i := 0; i < 2; i++ {
+		forward, reverse := makePatches(t, d, v[i], v[i+1])
+		applyPatch(t, d, v[i], forward, v[i+1])
+		applyPatch(t, d, v[i+1], reverse, v[i])
+
+		sig, err := d.MakeSignature(bytes.NewReader(v[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromSig := bytes.Buffer{}
+		if err := d.MakePatchFromSignature(sig, bytes.NewReader(v[i+1]), &fromSig); err != nil {
+			t.Fatal(err)
+		}
+		applyPatch(t, d, v[i], fromSig.Bytes(), v[i+1])
+	}
+}
@@ -0,0 +1,317 @@
+package dedup
+
+import (
+	"container/list"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// diskSlotKeySize is the max length of segment hashes (sha512) in the index
+	diskSlotKeySize = 64
+	// diskSlotSize is the size of a slot in the index file. Each slot holds:
+	// state (1) | key length (1) | pad (6) | key (64) | ID (8) | Length (8) | Freq (8)
+	diskSlotSize = 8 + diskSlotKeySize + 24
+	// diskProbeRun is the number of slots read at a time when probing
+	diskProbeRun = 16
+	// diskInitialSlots is the number of slots in a new index file
+	diskInitialSlots = 1 << 16
+)
+
+// states of a slot in the index file
+const (
+	diskSlotEmpty     = 0
+	diskSlotUsed      = 1
+	diskSlotForgotten = 2 // tombstone, so probing continues past it
+)
+
+// DiskTracker is a Tracker that keeps the stats of (at most) cacheSize of the
+// most recently seen segments in memory, and the stats of all the segments in
+// an index on disk. This allows inputs with more unique segments than can be
+// tracked in memory to be deduplicated.
+//
+// The index is an open addressing (linear probing) hash table of fixed size
+// slots stored in a temporary file. It is kept at most half full, and is
+// rebuilt in a file twice the size when it fills up. Forgotten segments leave
+// tombstones in their slots, which are dropped when the index is rebuilt.
+type DiskTracker struct {
+	dir       string
+	file      *os.File
+	slots     uint64 // number of slots in file
+	count     uint64 // number of slots (possibly) used by the segments seen
+	cacheSize int
+	lru       *list.List               // of *diskEntry, most recently used first
+	cache     map[string]*list.Element // cached segment stats (by hash)
+	// internal - tracks IDs we've issued to segments
+	segmentNum uint64
+	forgotten  forgottenStats
+}
+
+type diskEntry struct {
+	key   string
+	stat  SegmentStat
+	dirty bool // whether stat has changed since it was written to disk
+}
+
+// NewDiskTracker returns a DiskTracker that caches the stats of up to
+// cacheSize segments in memory, and keeps its index in a temporary file in dir
+// (or the default temp dir, if dir is ""). Close removes the file.
+func NewDiskTracker(dir string, cacheSize int) (*DiskTracker, error) {
+	if cacheSize <= 0 {
+		return nil, errors.Errorf("Invalid cache size (%d)", cacheSize)
+	}
+	file, err := newIndexFile(dir, diskInitialSlots)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskTracker{
+		dir:       dir,
+		file:      file,
+		slots:     diskInitialSlots,
+		cacheSize: cacheSize,
+		lru:       list.New(),
+		cache:     map[string]*list.Element{},
+		forgotten: forgottenStats{},
+	}, nil
+}
+
+// Track records the stats for the specified segment
+func (d *DiskTracker) Track(segment, seghash []byte) (SegmentStat, error) {
+	if len(seghash) > diskSlotKeySize {
+		return SegmentStat{}, errors.Errorf("Segment hash too long (%d bytes)", len(seghash))
+	}
+
+	key := string(seghash)
+	if elem, there := d.cache[key]; there {
+		d.lru.MoveToFront(elem)
+		entry := elem.Value.(*diskEntry)
+		entry.stat.Freq++
+		entry.dirty = true
+		return entry.stat, nil
+	}
+
+	entry := &diskEntry{key: key, dirty: true}
+	_, stat, found, err := d.lookup(key)
+	if err != nil {
+		return SegmentStat{}, err
+	}
+	if found {
+		entry.stat = stat
+		entry.stat.Freq++
+	} else {
+		d.segmentNum++
+		d.count++
+		entry.stat = SegmentStat{ID: d.segmentNum, Length: len(segment), Freq: 1}
+	}
+
+	d.cache[key] = d.lru.PushFront(entry)
+	if err := d.evict(d.cacheSize); err != nil {
+		return SegmentStat{}, err
+	}
+	return entry.stat, nil
+}
+
+// Forget drops the specified segment, its stats still count towards those
+// printed by PrintStats
+func (d *DiskTracker) Forget(seghash []byte) error {
+	key := string(seghash)
+	cached := false
+	if elem, there := d.cache[key]; there {
+		d.forgotten.add(elem.Value.(*diskEntry).stat)
+		d.lru.Remove(elem)
+		delete(d.cache, key)
+		cached = true
+	}
+
+	slot, stat, found, err := d.lookup(key)
+	if err != nil || !found {
+		return err
+	}
+	if !cached {
+		d.forgotten.add(stat)
+	}
+	if _, err := d.file.WriteAt([]byte{diskSlotForgotten}, int64(slot*diskSlotSize)); err != nil {
+		return errors.Wrapf(err, "Failed to write index")
+	}
+	return nil
+}
+
+// PrintStats prints the segment stats on the given output (io.Writer)
+func (d *DiskTracker) PrintStats(out io.Writer) error {
+	if err := d.evict(0); err != nil {
+		return err
+	}
+	return printStats(out, d.forEach)
+}
+
+// Close removes the index file
+func (d *DiskTracker) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	name := d.file.Name()
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	d.file = nil
+	return os.Remove(name)
+}
+
+// evict writes the least recently used stats to disk until at most n remain
+// in the cache
+func (d *DiskTracker) evict(n int) error {
+	for d.lru.Len() > n {
+		entry := d.lru.Remove(d.lru.Back()).(*diskEntry)
+		delete(d.cache, entry.key)
+		if !entry.dirty {
+			continue
+		}
+		if err := d.store(entry.key, entry.stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup finds the slot holding key, or the empty slot it would go in
+func (d *DiskTracker) lookup(key string) (uint64, SegmentStat, bool, error) {
+	var (
+		buf  = make([]byte, diskProbeRun*diskSlotSize)
+		slot = binary.LittleEndian.Uint64(padKey(key)) % d.slots
+	)
+	for {
+		run := min64(diskProbeRun, d.slots-slot)
+		if _, err := d.file.ReadAt(buf[:run*diskSlotSize], int64(slot*diskSlotSize)); err != nil {
+			return 0, SegmentStat{}, false, errors.Wrapf(err, "Failed to read index")
+		}
+		for i := uint64(0); i < run; i++ {
+			rec := buf[i*diskSlotSize : (i+1)*diskSlotSize]
+			switch {
+			case rec[0] == diskSlotEmpty:
+				return slot + i, SegmentStat{}, false, nil
+			case rec[0] == diskSlotUsed && string(rec[8:8+rec[1]]) == key:
+				return slot + i, decodeSlot(rec), true, nil
+			}
+		}
+		slot = (slot + run) % d.slots
+	}
+}
+
+// store writes the stats for key into the index, growing it if need be
+func (d *DiskTracker) store(key string, stat SegmentStat) error {
+	if d.count*2 > d.slots {
+		if err := d.grow(); err != nil {
+			return err
+		}
+	}
+	slot, _, _, err := d.lookup(key)
+	if err != nil {
+		return err
+	}
+	if _, err := d.file.WriteAt(encodeSlot(key, stat), int64(slot*diskSlotSize)); err != nil {
+		return errors.Wrapf(err, "Failed to write index")
+	}
+	return nil
+}
+
+// grow rebuilds the index in a new file with twice as many slots
+func (d *DiskTracker) grow() error {
+	old := &DiskTracker{file: d.file, slots: d.slots}
+	file, err := newIndexFile(d.dir, d.slots*2)
+	if err != nil {
+		return err
+	}
+	d.file = file
+	d.slots *= 2
+	d.count = uint64(d.lru.Len()) // recounted as the live slots are copied
+
+	err = old.forEachSlot(func(key string, stat SegmentStat) error {
+		d.count++
+		return d.store(key, stat)
+	})
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// forEach visits the stats of every segment in the index (and of those that
+// have been forgotten)
+func (d *DiskTracker) forEach(visit func(SegmentStat)) error {
+	d.forgotten.forEach(visit)
+	return d.forEachSlot(func(_ string, stat SegmentStat) error {
+		visit(stat)
+		return nil
+	})
+}
+
+// forEachSlot visits every used slot in the index
+func (d *DiskTracker) forEachSlot(visit func(string, SegmentStat) error) error {
+	buf := make([]byte, diskProbeRun*diskSlotSize)
+	for slot := uint64(0); slot < d.slots; slot += diskProbeRun {
+		run := min64(diskProbeRun, d.slots-slot)
+		if _, err := d.file.ReadAt(buf[:run*diskSlotSize], int64(slot*diskSlotSize)); err != nil {
+			return errors.Wrapf(err, "Failed to read index")
+		}
+		for i := uint64(0); i < run; i++ {
+			rec := buf[i*diskSlotSize : (i+1)*diskSlotSize]
+			if rec[0] != diskSlotUsed {
+				continue
+			}
+			if err := visit(string(rec[8:8+rec[1]]), decodeSlot(rec)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newIndexFile(dir string, slots uint64) (*os.File, error) {
+	file, err := ioutil.TempFile(dir, "dedup-index-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create index file")
+	}
+	if err := file.Truncate(int64(slots * diskSlotSize)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, errors.Wrapf(err, "Failed to size index file")
+	}
+	return file, nil
+}
+
+func encodeSlot(key string, stat SegmentStat) []byte {
+	rec := make([]byte, diskSlotSize)
+	rec[0] = diskSlotUsed
+	rec[1] = byte(len(key))
+	copy(rec[8:], key)
+	binary.LittleEndian.PutUint64(rec[8+diskSlotKeySize:], stat.ID)
+	binary.LittleEndian.PutUint64(rec[16+diskSlotKeySize:], uint64(stat.Length))
+	binary.LittleEndian.PutUint64(rec[24+diskSlotKeySize:], uint64(stat.Freq))
+	return rec
+}
+
+func decodeSlot(rec []byte) SegmentStat {
+	return SegmentStat{
+		ID:     binary.LittleEndian.Uint64(rec[8+diskSlotKeySize:]),
+		Length: int(binary.LittleEndian.Uint64(rec[16+diskSlotKeySize:])),
+		Freq:   int(binary.LittleEndian.Uint64(rec[24+diskSlotKeySize:])),
+	}
+}
+
+// padKey returns the first 8 bytes of key (zero padded) to pick a slot with
+func padKey(key string) []byte {
+	b := make([]byte, 8)
+	copy(b, key)
+	return b
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDiskTrackerMatchesSegmentTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a cache of 1 sends almost every lookup to the index, and more than
+	// diskInitialSlots segments make it grow (twice)
+	disk, err := NewDiskTracker(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	mem := NewSegmentTracker()
+
+	var (
+		rng      = rand.New(rand.NewSource(8))
+		segments = diskInitialSlots + diskInitialSlots/2
+		seghash  = func(n int) []byte {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(n))
+			sum := sha512.Sum512(b[:])
+			return sum[:]
+		}
+	)
+	for i := 0; i < 3*segments; i++ {
+		// mostly new segments early on, repeats (of old and recent ones) later
+		n := rng.Intn(i/2 + 1)
+		if i%3 == 0 {
+			n = i / 3
+		}
+		hash := seghash(n)
+
+		if rng.Intn(10) == 0 {
+			if err := disk.Forget(hash); err != nil {
+				t.Fatal(err)
+			}
+			if err := mem.Forget(hash); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		segment := make([]byte, 1+n%100)
+		want, err := mem.Track(segment, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := disk.Track(segment, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("Call %d (segment %d): got %+v, expected %+v", i, n, got, want)
+		}
+	}
+	if disk.slots <= diskInitialSlots*2 {
+		t.Fatalf("Index only has %d slots, expected it to have grown twice", disk.slots)
+	}
+
+	want, got := bytes.Buffer{}, bytes.Buffer{}
+	if err := mem.PrintStats(&want); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.PrintStats(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("Stats differ, got:\n%s\nexpected:\n%s", got.String(), want.String())
+	}
+}
@@ -0,0 +1,280 @@
+package dedup
+
+import (
+	"crypto/sha512"
+	"io"
+	"math"
+	"sync"
+)
+
+// parallelRegionSize is the size of the regions the input is split into when
+// segmenting with multiple workers
+const parallelRegionSize = 4 << 20
+
+// hashedSegmentHandler processes a segment along with its (sha512) hash
+type hashedSegmentHandler func(seg, seghash []byte) error
+
+// region is a chunk of the input whose rolling hashes are computed by a worker
+type region struct {
+	off   uint64      // offset of data[0] in the input
+	data  []byte      // the input bytes in this region
+	prime []byte      // input bytes preceding data (to prime the rolling hash)
+	cands []candidate // where the rolling hash permits a cut (set by worker)
+	err   error       // error encountered reading this region
+	done  chan struct{}
+}
+
+// candidate is a position where the rolling hash would permit a cut
+type candidate struct {
+	end    int  // end (exclusive) of the segment if cut here, relative to data
+	strict bool // whether the stricter mask (maskS) is also satisfied
+}
+
+// batch holds a run of segments whose hashes are computed by a worker
+type batch struct {
+	segs [][]byte
+	sums [][sha512.Size]byte
+	err  error // error encountered producing these segments
+	done chan struct{}
+}
+
+// segmentParallel segments the input using the given number of workers, and
+// calls handler (in order) with each segment and its hash. The output is
+// identical to segmenting serially (as SegmentFile does).
+//
+// The input is read in regions that are handed to workers which roll the hash
+// over each region, noting where the hash would permit a cut. Since the hash
+// at any point depends only on the trailing window of bytes, each worker primes
+// its hash with the bytes preceding its region and computes exactly what the
+// serial scan would have. The min/avg/max length rules depend on where the
+// previous segment ended, so they are applied (in order) to the candidates by a
+// single goroutine, which is cheap as it only visits candidate positions. The
+// resulting segments are then handed back to the workers to be hashed.
+func (s Segmenter) segmentParallel(input io.Reader, workers int, handler hashedSegmentHandler) error {
+	s, err := s.normalize()
+	if err != nil {
+		return err
+	}
+
+	var (
+		tasks   = make(chan func(), workers)
+		regions = make(chan *region, workers)
+		batches = make(chan *batch, workers)
+		quit    = make(chan struct{})
+		wg      = sync.WaitGroup{}
+	)
+	defer wg.Wait()
+	defer close(quit)
+
+	submit := func(task func()) bool {
+		select {
+		case tasks <- task:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+
+	// workers
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case task := <-tasks:
+					task()
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+
+	// reader: splits the input into regions and has the workers scan them
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(regions)
+
+		prev := []byte{}
+		for off := uint64(0); ; {
+			r := &region{off: off, data: make([]byte, parallelRegionSize), done: make(chan struct{})}
+			n, err := io.ReadFull(input, r.data)
+			r.data = r.data[:n]
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			if n == 0 && err == io.EOF {
+				return
+			}
+			if err != nil && err != io.EOF {
+				r.err = err
+				close(r.done)
+			} else {
+				r.prime = prev[len(prev)-minInt(len(prev), s.hashWindow()):]
+				if !submit(func() { s.scanRegion(r); close(r.done) }) {
+					return
+				}
+			}
+
+			select {
+			case regions <- r:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+			prev = r.data
+			off += uint64(n)
+		}
+	}()
+
+	// selector: applies the length rules to the candidates (in order) and has
+	// the workers hash the resulting segments
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+
+		var (
+			rules   = s.cutter()
+			start   = uint64(0) // offset of the segment being assembled
+			pending = []byte{}  // its bytes from previous regions
+		)
+		send := func(b *batch) bool {
+			if b.err != nil {
+				close(b.done)
+			} else if !submit(func() { b.hash(); close(b.done) }) {
+				return false
+			}
+			select {
+			case batches <- b:
+				return true
+			case <-quit:
+				return false
+			}
+		}
+
+		for r := range regions {
+			select {
+			case <-r.done:
+			case <-quit:
+				return
+			}
+
+			b := &batch{err: r.err, done: make(chan struct{})}
+			if r.err != nil {
+				send(b)
+				return
+			}
+
+			pos := 0 // where the unassigned bytes in this region begin
+			cut := func(end int) {
+				seg := r.data[pos:end]
+				if len(pending) > 0 {
+					seg = append(pending, seg...)
+					pending = []byte{}
+				}
+				b.segs = append(b.segs, seg)
+				start = r.off + uint64(end)
+				pos = end
+			}
+			forced := func() int { return int(start + rules.max - r.off) }
+
+			for _, c := range r.cands {
+				length := r.off + uint64(c.end) - start
+				for length > rules.max {
+					cut(forced())
+					length = r.off + uint64(c.end) - start
+				}
+				if length >= rules.min && (c.strict || length >= rules.avg) {
+					cut(c.end)
+				}
+			}
+			for r.off+uint64(len(r.data))-start >= rules.max {
+				cut(forced())
+			}
+			pending = append(pending, r.data[pos:]...)
+
+			if !send(b) {
+				return
+			}
+		}
+
+		// whatever is left over is the last segment
+		if len(pending) > 0 {
+			send(&batch{segs: [][]byte{pending}, done: make(chan struct{})})
+		}
+	}()
+
+	// hand the hashed segments to the handler in order
+	for b := range batches {
+		<-b.done
+		if b.err != nil {
+			return b.err
+		}
+		for i, seg := range b.segs {
+			if err := handler(seg, b.sums[i][:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanRegion rolls the hash over the region, noting the candidate cut points
+func (s Segmenter) scanRegion(r *region) {
+	var (
+		roller = s.rollingHash()
+		rules  = s.cutter()
+		// probe accepts a cut wherever the hash satisfies the looser mask
+		probe = cutter{maskS: rules.maskL, maskL: rules.maskL, max: math.MaxUint64}
+	)
+
+	for _, b := range r.prime {
+		roller.Roll(b)
+	}
+
+	for pos := 0; pos < len(r.data); {
+		found := false
+		if br, ok := roller.(blockRoller); ok {
+			n, cut := br.rollUntil(r.data[pos:], 0, &probe)
+			pos, found = pos+n, cut
+		} else {
+			found = probe.cut(roller.Roll(r.data[pos]), 0)
+			pos++
+		}
+		if found {
+			r.cands = append(r.cands, candidate{end: pos, strict: roller.Sum()&rules.maskS == 0})
+		}
+	}
+}
+
+// hash computes the hashes of all the segments in the batch
+func (b *batch) hash() {
+	b.sums = make([][sha512.Size]byte, len(b.segs))
+	for i, seg := range b.segs {
+		b.sums[i] = sha512.Sum512(seg)
+	}
+}
+
+// hashWindow returns the number of trailing bytes the rolling hash depends on
+func (s Segmenter) hashWindow() int {
+	switch {
+	case s.NewRollingHash != nil:
+		return int(s.WindowSize)
+	case s.Algorithm == AlgorithmGear || s.Algorithm == AlgorithmFastCDC:
+		return 64
+	default:
+		return int(s.WindowSize)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,80 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"testing"
+)
+
+// segmentsInParallel returns (copies of) the segments segmentParallel finds in
+// data, checking the hash it hands over with each
+func segmentsInParallel(t *testing.T, s Segmenter, data []byte, workers int) [][]byte {
+	segs := [][]byte{}
+	err := s.segmentParallel(bytes.NewReader(data), workers, func(seg, seghash []byte) error {
+		if sum := sha512.Sum512(seg); !bytes.Equal(seghash, sum[:]) {
+			t.Fatalf("Wrong hash for segment %d", len(segs))
+		}
+		segs = append(segs, append([]byte{}, seg...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segs
+}
+
+func TestSegmentParallel(t *testing.T) {
+	// inputs span several regions, with one ending exactly at a region edge
+	inputs := map[string][]byte{
+		"empty":  {},
+		"short":  testInput(100<<10, 4),
+		"edge":   testInput(2*parallelRegionSize, 5),
+		"uneven": testInput(3*parallelRegionSize+12345, 6),
+	}
+	params := []struct {
+		name               string
+		min, avg, max, win uint64
+	}{
+		{"default", 0, 4096, 16384, 64},
+		// max isn't a power of 2, so forced cuts fall all over the region
+		// edges, and the min is close to it so most hash cuts are skipped
+		{"forced", 1000, 1024, 1500, 48},
+		// segments span region edges
+		{"large", 0, 1 << 20, 3 << 20, 64},
+	}
+
+	for _, algo := range algorithms {
+		for _, p := range params {
+			s, err := NewSegmenter(algo, p.win, p.min, p.avg, p.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range inputs {
+				t.Run(algo.String()+"/"+p.name+"/"+name, func(t *testing.T) {
+					want := segmentsOf(t, s, data)
+					got := segmentsInParallel(t, s, data, 4)
+					compareSegments(t, got, want)
+				})
+			}
+		}
+	}
+}
+
+func TestSegmentParallelCustomRollingHash(t *testing.T) {
+	s := testSegmenter(t, AlgorithmRabinKarp)
+	s.NewRollingHash = func() RollingHash { return struct{ RollingHash }{NewRabinKarp(s.WindowSize)} }
+	data := testInput(2*parallelRegionSize+777, 7)
+	compareSegments(t, segmentsInParallel(t, s, data, 4), segmentsOf(t, s, data))
+}
+
+// compareSegments fails the test if got and want aren't the same segments
+func compareSegments(t *testing.T, got, want [][]byte) {
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("Segment %d differs (%d bytes, expected %d)", i, len(got[i]), len(want[i]))
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Found %d segments, expected %d", len(got), len(want))
+	}
+}
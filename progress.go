@@ -0,0 +1,70 @@
+package dedup
+
+import (
+	"io"
+)
+
+// Progress is a snapshot of how far a Deduplicator (or Reduplicator) has got
+type Progress struct {
+	BytesIn     uint64 // bytes consumed from the input stream
+	BytesOut    uint64 // bytes written to the output stream
+	Segments    uint64 // segments seen
+	DupSegments uint64 // segments that were duplicates of earlier ones
+	DupBytes    uint64 // total length of the duplicate segments
+}
+
+// DupRatio returns the fraction of the data seen so far that was duplicate
+func (p Progress) DupRatio() float64 {
+	total := p.BytesIn
+	if p.BytesOut > total {
+		total = p.BytesOut // reduplicating, the output is the original data
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(p.DupBytes) / float64(total)
+}
+
+// ProgressFunc is called with the progress made, after every segment (so it
+// should return quickly)
+type ProgressFunc func(Progress)
+
+// CountingReader counts the bytes read through it
+type CountingReader struct {
+	reader io.Reader
+	count  uint64
+}
+
+// NewCountingReader returns a CountingReader that reads from reader
+func NewCountingReader(reader io.Reader) *CountingReader {
+	return &CountingReader{reader: reader}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += uint64(n)
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (c *CountingReader) Count() uint64 { return c.count }
+
+// CountingWriter counts the bytes written through it
+type CountingWriter struct {
+	writer io.Writer
+	count  uint64
+}
+
+// NewCountingWriter returns a CountingWriter that writes to writer
+func NewCountingWriter(writer io.Writer) *CountingWriter {
+	return &CountingWriter{writer: writer}
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count += uint64(n)
+	return n, err
+}
+
+// Count returns the number of bytes written so far
+func (c *CountingWriter) Count() uint64 { return c.count }
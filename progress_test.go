@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"testing"
+)
+
+// recordProgress returns a ProgressFunc that appends to the given slice
+func recordProgress(reports *[]Progress) ProgressFunc {
+	return func(p Progress) { *reports = append(*reports, p) }
+}
+
+// checkProgress checks that the reports only ever went up, and ended at last
+func checkProgress(t *testing.T, reports []Progress, last Progress) {
+	t.Helper()
+	if len(reports) < int(last.Segments) {
+		t.Fatalf("Got %d progress reports for %d segments", len(reports), last.Segments)
+	}
+	for i := 1; i < len(reports); i++ {
+		prev, cur := reports[i-1], reports[i]
+		if cur.BytesIn < prev.BytesIn || cur.BytesOut < prev.BytesOut ||
+			cur.Segments < prev.Segments || cur.DupBytes < prev.DupBytes {
+			t.Fatalf("Progress went backwards, from %+v to %+v", prev, cur)
+		}
+	}
+	if got := reports[len(reports)-1]; got != last {
+		t.Fatalf("Final progress is %+v, expected %+v", got, last)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var (
+		half = testInput(1<<20, 35)
+		data = concat(half, half)
+		s    = testSegmenter(t, AlgorithmGear)
+	)
+
+	// work out what is duplicate from the segments themselves
+	want := Progress{BytesIn: uint64(len(data))}
+	seen := map[[sha512.Size]byte]bool{}
+	for _, seg := range segmentsOf(t, s, data) {
+		want.Segments++
+		if sum := sha512.Sum512(seg); seen[sum] {
+			want.DupSegments++
+			want.DupBytes += uint64(len(seg))
+		} else {
+			seen[sum] = true
+		}
+	}
+	if want.DupBytes < uint64(len(half))/2 {
+		t.Fatalf("Only %d of the %d bytes repeated are in duplicate segments", want.DupBytes, len(half))
+	}
+
+	d, err := NewDeduplicatorWithOptions(Options{Segmenter: s, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	reports := []Progress{}
+	d.SetProgress(recordProgress(&reports))
+	stream := bytes.Buffer{}
+	if err := d.Do(bytes.NewReader(data), &stream); err != nil {
+		t.Fatal(err)
+	}
+	want.BytesOut = uint64(stream.Len())
+	checkProgress(t, reports, want)
+
+	// the Reduplicator sees the same segments, with in and out swapped
+	r := NewReduplicator()
+	defer r.Close()
+	reports = reports[:0]
+	r.SetProgress(recordProgress(&reports))
+	if err := r.Do(bytes.NewReader(stream.Bytes()), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	want.BytesIn, want.BytesOut = want.BytesOut, want.BytesIn
+	checkProgress(t, reports, want)
+}
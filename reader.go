@@ -0,0 +1,59 @@
+package dedup
+
+import (
+	"io"
+)
+
+// Reader is an io.ReadCloser that reduplicates a dedup stream on demand, so
+// that the original data can be read in place by any io.Reader consumer (e.g.
+// tar.NewReader). Records are only decoded as the data they carry is read.
+type Reader struct {
+	redup *Reduplicator
+	src   io.Reader
+	dec   *decoder // nil until the header has been read
+	buf   []byte   // unread bytes of the current segment
+	err   error    // sticky error (io.EOF at the end of the stream)
+}
+
+// NewReader returns a Reader of the data deduplicated in the stream src. The
+// header is read (and checked) on the first Read.
+func NewReader(src io.Reader) *Reader {
+	return NewReaderWithStore(src, NewMemoryStore())
+}
+
+// NewReaderWithStore returns a Reader (see NewReader) that keeps the segments
+// it has seen in the given SegmentStore
+func NewReaderWithStore(src io.Reader, store SegmentStore) *Reader {
+	return &Reader{
+		redup: NewReduplicatorWithStore(store),
+		src:   src,
+	}
+}
+
+// Read reads the reduplicated data into p
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.dec == nil {
+			header, reader, err := openStream(r.src)
+			if err != nil {
+				r.err = err
+				continue
+			}
+			r.dec = r.redup.newDecoder(header, reader)
+		}
+		r.buf, r.err = r.dec.next()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close releases the resources (e.g. spill files) held by the Reader, it does
+// not close the source stream
+func (r *Reader) Close() error {
+	return r.redup.Close()
+}
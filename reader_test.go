@@ -0,0 +1,98 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/amoghe/dedup/codec"
+)
+
+// readInPieces reads r till EOF into buffers of random (odd) sizes
+func readInPieces(r io.Reader, seed int64) ([]byte, error) {
+	var (
+		rng    = rand.New(rand.NewSource(seed))
+		output = []byte{}
+	)
+	for {
+		p := make([]byte, 1+2*rng.Intn(20000))
+		n, err := r.Read(p)
+		output = append(output, p[:n]...)
+		if err == io.EOF {
+			return output, nil
+		} else if err != nil {
+			return output, err
+		}
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	data := testInput(3*parallelRegionSize+12345, 27)
+	for _, opts := range []Options{
+		{Workers: 1, Checksums: false},
+		{Workers: 1, Checksums: true},
+		{Workers: 4, Checksums: false},
+		{Workers: 4, Checksums: true},
+	} {
+		opts.Segmenter = testSegmenter(t, AlgorithmGear)
+		stream := bytes.Buffer{}
+		w, err := NewWriter(&stream, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeInPieces(t, w, data, 28)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewReader(&stream)
+		output, err := readInPieces(r, 29)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if !bytes.Equal(output, data) {
+			t.Fatalf("Workers %d, checksums %v: read %d bytes, expected the %d bytes written",
+				opts.Workers, opts.Checksums, len(output), len(data))
+		}
+	}
+}
+
+func TestReaderCorruptStream(t *testing.T) {
+	data := testInput(1<<20, 30)
+	header, msgs := dedupMessages(t, codec.KindProtobuf, data)
+
+	// a corrupt Def is reported (by every Read) once the data before it is read
+	var (
+		corrupted = append([]codec.Message{}, msgs...)
+		record    = len(msgs) - 2
+		offset    = len(data) - len(msgs[record].DefBytes)
+	)
+	if msgs[record].Type != codec.MessageDef {
+		t.Fatalf("Record %d is of type %d, expected a Def", record, msgs[record].Type)
+	}
+	corrupted[record].DefBytes = append([]byte{}, msgs[record].DefBytes...)
+	corrupted[record].DefBytes[0] ^= 0x80
+
+	r := NewReader(bytes.NewReader(encodeStream(t, header, corrupted)))
+	defer r.Close()
+	output, err := readInPieces(r, 31)
+	if corrupt := corruptRecord(t, err); corrupt.Record != uint64(record) || corrupt.Offset != uint64(offset) {
+		t.Fatalf("Got corrupt record %d at offset %d, expected record %d at offset %d",
+			corrupt.Record, corrupt.Offset, record, offset)
+	}
+	if !bytes.Equal(output, data[:offset]) {
+		t.Fatalf("Read %d bytes before the corrupt record, expected %d", len(output), offset)
+	}
+	if _, again := r.Read(make([]byte, 1)); again != err {
+		t.Fatalf("Read after the error returned %v, expected %v", again, err)
+	}
+
+	// so is a truncated stream, after all of its data
+	r = NewReader(bytes.NewReader(encodeStream(t, header, msgs[:len(msgs)-1])))
+	defer r.Close()
+	if output, err := readInPieces(r, 32); err == nil || !bytes.Equal(output, data) {
+		t.Fatalf("Read %d bytes (err %v) from a stream without its trailer", len(output), err)
+	}
+}
@@ -1,8 +1,11 @@
 package dedup
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 
 	"github.com/amoghe/dedup/codec"
 	"github.com/pkg/errors"
@@ -10,52 +13,323 @@ import (
 
 // Reduplicator performs reduplication of the specified file
 type Reduplicator struct {
-	tracker map[uint64][]byte
+	tracker SegmentStore
+
+	// stats
+	msgsProcessed uint64
+	defCount      uint64
+	refCount      uint64
+	forgetCount   uint64
+	defBytes      uint64
+	refBytes      uint64
+	copyCount     uint64
+	copyBytes     uint64
+	checksums     bool // whether the stream carried checksums (that were verified)
+
+	input      *CountingReader // input of the current Do
+	onProgress ProgressFunc
+}
+
+// UnknownRefError is returned when a stream refers to a segment that was never
+// defined (or was forgotten)
+type UnknownRefError struct {
+	ID     uint64 // ID of the segment referred to
+	Record uint64 // index of the Ref in the stream (0 is the first record)
+}
+
+func (e *UnknownRefError) Error() string {
+	return fmt.Sprintf("Record %d refers to unknown segment ID %d", e.Record, e.ID)
 }
 
 // NewReduplicator returns a Reduplicator
 func NewReduplicator() *Reduplicator {
 	d := Reduplicator{
-		tracker: map[uint64][]byte{},
+		tracker: NewMemoryStore(),
 	}
 	return &d
 }
 
+// NewReduplicatorWithStore returns a Reduplicator that keeps the segments it
+// has seen in the given SegmentStore
+func NewReduplicatorWithStore(store SegmentStore) *Reduplicator {
+	d := Reduplicator{
+		tracker: store,
+	}
+	return &d
+}
+
+// NewReduplicatorWithBudget returns a Reduplicator that keeps (roughly) at most
+// budget bytes of segments in memory, spilling the rest to a temporary file in
+// dir (or the default temp dir, if dir is ""). The output is the same as that
+// of a Reduplicator without a budget. Close must be called to remove the file.
+func NewReduplicatorWithBudget(budget int64, dir string) *Reduplicator {
+	return NewReduplicatorWithStore(NewSpillStore(budget, dir))
+}
+
 // Do runs the reduplication writing the output to the output stream
 func (r *Reduplicator) Do(input io.Reader, output io.Writer) error {
-	reader := codec.NewGobReader(input)
+	return r.DoContext(context.Background(), input, output)
+}
 
+// DoContext runs the reduplication writing the output to the output stream,
+// giving up (returning ctx.Err()) between records once ctx is done
+func (r *Reduplicator) DoContext(ctx context.Context, input io.Reader, output io.Writer) error {
+	r.input = NewCountingReader(input)
+	header, reader, err := openStream(r.input)
+	if err != nil {
+		return err
+	}
+	return r.replay(ctx, r.newDecoder(header, reader), output)
+}
+
+// replay reassembles the records decoded by dec into the output
+func (r *Reduplicator) replay(ctx context.Context, dec *decoder, output io.Writer) error {
 	for {
-		msg, err := reader.Read()
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		seg, err := dec.next()
 		if err == io.EOF {
-			break
+			r.report()
+			return nil
 		} else if err != nil {
 			return err
 		}
+		if len(seg) == 0 {
+			continue
+		}
+		if _, err := output.Write(seg); err != nil {
+			return errors.Wrapf(err, "Failed to write output")
+		}
+		r.report()
+	}
+}
+
+// SetProgress sets the function that is passed the progress made (by Do) after
+// every segment
+func (r *Reduplicator) SetProgress(fn ProgressFunc) {
+	r.onProgress = fn
+}
 
-		switch msg.Type {
-		case codec.MessageDef:
-			r.handleSegmentDef(&msg, output)
-		case codec.MessageRef:
-			r.handleSegmentRef(&msg, output)
-		default:
-			return errors.Errorf("Unexpected type in input stream: %d", msg.Type)
+// report passes the progress made so far to the ProgressFunc (if any)
+func (r *Reduplicator) report() {
+	if r.onProgress == nil {
+		return
+	}
+	progress := Progress{
+		BytesOut:    r.defBytes + r.refBytes + r.copyBytes,
+		Segments:    r.defCount + r.refCount + r.copyCount,
+		DupSegments: r.refCount + r.copyCount,
+		DupBytes:    r.refBytes + r.copyBytes,
+	}
+	if r.input != nil {
+		progress.BytesIn = r.input.count
+	}
+	r.onProgress(progress)
+}
+
+// decoder decodes the records of a stream one at a time, resolving them using
+// the segments held by a Reduplicator
+type decoder struct {
+	redup  *Reduplicator
+	reader codec.Reader
+	check  *verifier // nil unless the stream carries checksums
+	record uint64    // index of the next record
+
+	base    io.ReaderAt    // base file Copy messages refer to (patches only)
+	copying *codec.Message // Copy being output (in pieces), if any
+	copyBuf []byte
+}
+
+// copyPieceSize bounds the bytes of a Copy that are output at once
+const copyPieceSize = 1 << 20
+
+func (r *Reduplicator) newDecoder(header codec.Header, reader codec.Reader) *decoder {
+	dec := &decoder{redup: r, reader: reader}
+	if header.Flags&codec.FlagChecksums != 0 {
+		dec.check = newVerifier()
+	}
+	r.checksums = dec.check != nil
+	return dec
+}
+
+// next decodes the next record and returns the output bytes it carries (none
+// for e.g. a Forget), or io.EOF at the end of the stream. The bytes may be held
+// by the segment store, so they must not be modified, and are only valid till
+// the next call. The bytes of a long Copy are returned over several calls.
+func (d *decoder) next() ([]byte, error) {
+	if d.copying != nil {
+		return d.copyPiece()
+	}
+
+	msg, err := d.reader.Read()
+	if err == io.EOF {
+		if d.check != nil {
+			if err := d.check.finish(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := d.record
+	d.record++
+	if d.check != nil {
+		if err := d.check.check(&msg); err != nil {
+			return nil, err
+		}
+	}
+
+	var seg []byte
+	switch msg.Type {
+	case codec.MessageDef:
+		seg, err = d.redup.handleSegmentDef(&msg)
+	case codec.MessageRef:
+		seg, err = d.redup.handleSegmentRef(&msg, record)
+	case codec.MessageForget:
+		d.redup.forgetCount++
+		err = d.redup.tracker.Delete(msg.RefID)
+	case codec.MessageTrailer:
+		if d.check == nil {
+			err = errors.Errorf("Unexpected trailer in stream without checksums")
+		}
+	case codec.MessageCopy:
+		if d.base == nil {
+			return nil, errors.Errorf("Unexpected copy (record %d) in stream without a base file", record)
+		}
+		d.redup.msgsProcessed++
+		d.redup.copyCount++
+		d.copying = &msg
+		return d.copyPiece()
+	default:
+		return nil, errors.Errorf("Unexpected type in input stream: %d", msg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.check != nil {
+		d.check.Write(seg)
+	}
+	d.redup.msgsProcessed++
+	return seg, nil
+}
+
+// copyPiece reads (and returns) the next piece of the Copy being output from
+// the base file
+func (d *decoder) copyPiece() ([]byte, error) {
+	length := d.copying.Length
+	if length > copyPieceSize {
+		length = copyPieceSize
+	}
+	if uint64(cap(d.copyBuf)) < length {
+		d.copyBuf = make([]byte, length)
+	}
+	piece := d.copyBuf[:length]
+
+	if _, err := d.base.ReadAt(piece, int64(d.copying.Offset)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		//r.msgsProcessed++
+		return nil, errors.Wrapf(err, "Failed to copy %d bytes at offset %d of the base file",
+			length, d.copying.Offset)
 	}
+	d.copying.Offset += length
+	d.copying.Length -= length
+	if d.copying.Length == 0 {
+		d.copying = nil
+	}
+
+	if d.check != nil {
+		d.check.Write(piece)
+	}
+	d.redup.copyBytes += length
+	return piece, nil
+}
+
+// openStream reads the header from the start of the input and returns it along
+// with a codec.Reader for the messages that follow it
+func openStream(input io.Reader) (codec.Header, codec.Reader, error) {
+	buffered := bufio.NewReader(input)
+	header, err := codec.ReadHeader(buffered)
+	if err != nil {
+		return header, nil, errors.Wrapf(err, "Invalid stream header")
+	}
+	if header.Flags&codec.FlagSignature != 0 {
+		return header, nil, errors.Errorf("Input is a signature, not a dedup stream")
+	}
+	reader, err := codec.NewReader(header.Codec, buffered)
+	return header, reader, err
+}
+
+// Checksummed returns whether the stream (of the last Do) carried checksums,
+// i.e. whether its integrity was verified as it was reduplicated
+func (r *Reduplicator) Checksummed() bool {
+	return r.checksums
+}
+
+// PrintStats prints stats about the records reduplicated so far to out
+func (r *Reduplicator) PrintStats(out io.Writer) error {
+	output := struct {
+		Checksums   bool
+		NumRecords  uint64
+		DefCount    uint64
+		RefCount    uint64
+		ForgetCount uint64
+		UniqueBytes uint64
+		DupBytes    uint64
+		CopyCount   uint64 `json:",omitempty"`
+		CopyBytes   uint64 `json:",omitempty"`
+		TotalBytes  uint64
+	}{
+		Checksums:   r.checksums,
+		NumRecords:  r.msgsProcessed,
+		DefCount:    r.defCount,
+		RefCount:    r.refCount,
+		ForgetCount: r.forgetCount,
+		UniqueBytes: r.defBytes,
+		DupBytes:    r.refBytes,
+		CopyCount:   r.copyCount,
+		CopyBytes:   r.copyBytes,
+		TotalBytes:  r.defBytes + r.refBytes + r.copyBytes,
+	}
+
+	marshalled, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal stats into JSON output")
+	}
+	fmt.Fprintln(out, string(marshalled))
 	return nil
 }
 
-func (r *Reduplicator) handleSegmentDef(msg *codec.Message, out io.Writer) {
-	r.tracker[msg.DefID] = msg.DefBytes
-	// receipt of def is implicit ref, so output the bytes
-	out.Write(msg.DefBytes)
+// Close releases the resources (e.g. spill files) held by the Reduplicator
+func (r *Reduplicator) Close() error {
+	return r.tracker.Close()
 }
 
-func (r *Reduplicator) handleSegmentRef(msg *codec.Message, out io.Writer) {
-	bytes, there := r.tracker[msg.RefID]
+// handleSegmentDef stores the defined segment and returns its bytes (receipt
+// of a def is an implicit ref)
+func (r *Reduplicator) handleSegmentDef(msg *codec.Message) ([]byte, error) {
+	if err := r.tracker.Put(msg.DefID, msg.DefBytes); err != nil {
+		return nil, err
+	}
+	r.defCount++
+	r.defBytes += uint64(len(msg.DefBytes))
+	return msg.DefBytes, nil
+}
+
+// handleSegmentRef returns the bytes of the referenced segment
+func (r *Reduplicator) handleSegmentRef(msg *codec.Message, record uint64) ([]byte, error) {
+	bytes, there, err := r.tracker.Get(msg.RefID)
+	if err != nil {
+		return nil, err
+	}
 	if !there {
-		log.Panicln("Got Ref for previously unseed ID:", msg.RefID)
+		return nil, &UnknownRefError{ID: msg.RefID, Record: record}
 	}
-	out.Write(bytes)
+	r.refCount++
+	r.refBytes += uint64(len(bytes))
+	return bytes, nil
 }
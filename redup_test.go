@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+func TestReduplicatorChecksummed(t *testing.T) {
+	data := testInput(1<<20, 10)
+	for _, checksums := range []bool{true, false} {
+		d, err := NewDeduplicatorWithOptions(Options{
+			Segmenter: testSegmenter(t, AlgorithmBuzhash),
+			Checksums: checksums,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deduped := bytes.Buffer{}
+		if err := d.Do(bytes.NewReader(data), &deduped); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		r := NewReduplicator()
+		if err := r.Do(&deduped, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if r.Checksummed() != checksums {
+			t.Fatalf("Checksummed is %v for a stream written with checksums %v", r.Checksummed(), checksums)
+		}
+		r.Close()
+	}
+}
+
+func TestUnknownRef(t *testing.T) {
+	header, msgs := dedupMessages(t, codec.KindBinary, testInput(1<<20, 22))
+	record := len(msgs) / 2
+	dangling := codec.Message{Type: codec.MessageRef, RefID: 1 << 40}
+	msgs = append(msgs[:record], append([]codec.Message{dangling}, msgs[record:]...)...)
+
+	err := redupStream(encodeStream(t, header, msgs))
+	unknown, ok := errors.Cause(err).(*UnknownRefError)
+	if !ok {
+		t.Fatalf("Expected an UnknownRefError, got %v", err)
+	}
+	if unknown.Record != uint64(record) || unknown.ID != dangling.RefID {
+		t.Fatalf("Got record %d referring to ID %d, expected record %d referring to ID %d",
+			unknown.Record, unknown.ID, record, dangling.RefID)
+	}
+}
+
+// failingWriter fails every write once limit bytes have been written to it
+type failingWriter struct {
+	limit int
+	err   error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, w.err
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestReduplicatorWriteError(t *testing.T) {
+	header, msgs := dedupMessages(t, codec.KindGob, testInput(1<<20, 23))
+	output := &failingWriter{limit: 1 << 19, err: errors.New("disk full")}
+	r := NewReduplicator()
+	defer r.Close()
+	if err := r.Do(bytes.NewReader(encodeStream(t, header, msgs)), output); errors.Cause(err) != output.err {
+		t.Fatalf("Expected the write error, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package dedup
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+// MakePatches writes both the patch from "old" to "new" (to forward, as
+// MakePatch does) and the patch from "new" back to "old" (to reverse), in one
+// pass over old and new. Segments of old are held (see SetStore) until new has
+// been read, those that aren't in new are then written to the reverse patch.
+func (d *Differ) MakePatches(old, new io.Reader, forward, reverse io.Writer) error {
+	return d.MakePatchesContext(context.Background(), old, new, forward, reverse)
+}
+
+// MakePatchesContext is MakePatches, but gives up (returning ctx.Err()) once
+// ctx is done
+func (d *Differ) MakePatchesContext(ctx context.Context, old, new io.Reader, forward, reverse io.Writer) error {
+	if d.dedup.window != nil {
+		return errors.Errorf("Reverse patches can't be made with an LRU window")
+	}
+	segmenter, err := d.dedup.segmenter.normalize()
+	if err != nil {
+		return err
+	}
+
+	store := d.store
+	if store == nil {
+		store = NewMemoryStore()
+		defer store.Close()
+	}
+	dedup := d.deduplicator(segmenter)
+	defer dedup.Close()
+	rev := &reverser{store: store, inNew: map[uint64]uint64{}}
+	if err := dedup.makePatch(ctx, old, new, forward, rev); err != nil {
+		return err
+	}
+
+	// the reverse patch applies to new, and recreates old
+	base := dedup.digest.trailer()
+	header := dedup.header(segmenter)
+	header.Flags |= codec.FlagPatch
+	header.BaseSize = base.TotalBytes
+	header.BaseDigest = base.Digest
+	header.BaseIDs = rev.newIDs
+	if err := rev.write(ctx, header, reverse); err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to write reverse patch"))
+	}
+	return nil
+}
+
+// SetStore sets where MakePatches holds the segments of old (a MemoryStore by
+// default), e.g. a SpillStore to bound the memory used
+func (d *Differ) SetStore(store SegmentStore) {
+	d.store = store
+}
+
+// reverser records the messages written for old and new by MakePatches, to
+// write the reverse patch from them
+type reverser struct {
+	oldIDs     []uint64          // ID of every segment of old, in order
+	oldLastID  uint64            // highest ID used by old
+	oldTrailer codec.Message     // describes old
+	store      SegmentStore      // segments of old (until they are seen in new)
+	inNew      map[uint64]uint64 // ID (as numbered in new) of the segments of old that are in new
+	newIDs     uint64            // number of unique segments in new
+}
+
+// recordOld records a message written for old
+func (r *reverser) recordOld(msg *codec.Message) error {
+	switch msg.Type {
+	case codec.MessageDef:
+		r.oldIDs = append(r.oldIDs, msg.DefID)
+		r.oldLastID = msg.DefID
+		return r.store.Put(msg.DefID, append([]byte{}, msg.DefBytes...))
+	case codec.MessageRef:
+		r.oldIDs = append(r.oldIDs, msg.RefID)
+	case codec.MessageTrailer:
+		r.oldTrailer = *msg
+	}
+	return nil
+}
+
+// recordNew records a message written for new, numbering its segments as a
+// Deduplicator would (in order of their first occurrence)
+func (r *reverser) recordNew(msg *codec.Message) error {
+	switch msg.Type {
+	case codec.MessageDef:
+		r.newIDs++ // not in old
+	case codec.MessageRef:
+		if _, there := r.inNew[msg.RefID]; msg.RefID <= r.oldLastID && !there {
+			r.newIDs++
+			r.inNew[msg.RefID] = r.newIDs
+			return r.store.Delete(msg.RefID) // the reverse patch refers to it
+		}
+	}
+	return nil
+}
+
+// write writes the reverse patch (described by header) to the output
+func (r *reverser) write(ctx context.Context, header codec.Header, output io.Writer) error {
+	writer, err := codec.NewWriter(header.Codec, output)
+	if err != nil {
+		return err
+	}
+	if err := codec.WriteHeader(output, header); err != nil {
+		return err
+	}
+
+	// segments only in old are given IDs past those of new
+	defined := map[uint64]uint64{}
+	for _, id := range r.oldIDs {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+
+		msg := codec.Message{Type: codec.MessageRef}
+		if newID, there := r.inNew[id]; there {
+			msg.RefID = newID
+		} else if revID, there := defined[id]; there {
+			msg.RefID = revID
+		} else {
+			seg, there, err := r.store.Get(id)
+			if err != nil {
+				return err
+			}
+			if !there {
+				return errors.Errorf("Segment %d of old file is missing from the store", id)
+			}
+			revID := header.BaseIDs + uint64(len(defined)) + 1
+			defined[id] = revID
+			msg = codec.Message{
+				Type:     codec.MessageDef,
+				DefID:    revID,
+				DefBytes: seg,
+				Checksum: crc32.Checksum(seg, castagnoli),
+			}
+		}
+		if err := writer.Write(&msg); err != nil {
+			return err
+		}
+	}
+	return writer.Write(&r.oldTrailer)
+}
+
+// tapWriter is a codec.Writer that passes every message to tap before writing
+// it
+type tapWriter struct {
+	writer codec.Writer
+	tap    func(msg *codec.Message) error
+}
+
+func (t *tapWriter) Write(msg *codec.Message) error {
+	if err := t.tap(msg); err != nil {
+		return err
+	}
+	return t.writer.Write(msg)
+}
@@ -0,0 +1,70 @@
+package dedup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// makePatches returns the forward and reverse patches between old and new
+func makePatches(t *testing.T, d *Differ, old, new []byte) ([]byte, []byte) {
+	forward, reverse := bytes.Buffer{}, bytes.Buffer{}
+	if err := d.MakePatches(bytes.NewReader(old), bytes.NewReader(new), &forward, &reverse); err != nil {
+		t.Fatal(err)
+	}
+	return forward.Bytes(), reverse.Bytes()
+}
+
+func TestMakePatches(t *testing.T) {
+	for _, algo := range algorithms {
+		t.Run(algo.String(), func(t *testing.T) {
+			var (
+				v                = testVersions(1<<20, 2, 18)
+				d                = testDiffer(t, testSegmenter(t, algo))
+				forward, reverse = makePatches(t, d, v[0], v[1])
+			)
+			if !bytes.Equal(forward, makePatch(t, d, v[0], v[1])) {
+				t.Fatalf("Forward patch differs from the one MakePatch makes")
+			}
+			applyPatch(t, d, v[0], forward, v[1])
+			applyPatch(t, d, v[1], reverse, v[0])
+		})
+	}
+}
+
+func TestMakePatchesWithSpillStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a budget of 0 spills every segment of old to disk
+	var (
+		v     = testVersions(1<<20, 2, 19)
+		s     = testSegmenter(t, AlgorithmFastCDC)
+		d     = testDiffer(t, s)
+		store = NewSpillStore(0, dir)
+	)
+	defer store.Close()
+	d.SetStore(store)
+
+	forward, reverse := makePatches(t, d, v[0], v[1])
+	if len(store.spilled) == 0 {
+		t.Fatalf("Nothing was spilled")
+	}
+	applyPatch(t, d, v[0], forward, v[1])
+	applyPatch(t, d, v[1], reverse, v[0])
+}
+
+func TestMakePatchesWithLRUWindow(t *testing.T) {
+	d, err := NewDifferWithOptions(Options{Segmenter: testSegmenter(t, AlgorithmBuzhash), LRUSegments: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.MakePatches(bytes.NewReader(nil), bytes.NewReader(nil), ioutil.Discard, ioutil.Discard)
+	if err == nil {
+		t.Fatalf("Expected reverse patches to be refused with an LRU window")
+	}
+}
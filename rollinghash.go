@@ -0,0 +1,194 @@
+package dedup
+
+import (
+	"math/bits"
+
+	"github.com/kch42/buzhash"
+)
+
+// RollingHash computes a hash over a window of bytes that slides over the
+// input one byte at a time. Segmenters test the low bits of the sum against
+// their mask, so implementations must ensure those bits are well mixed.
+type RollingHash interface {
+	// Reset clears the state, as if no bytes had been rolled in yet
+	Reset()
+	// Roll slides the window forward by one byte and returns the new sum
+	Roll(b byte) uint64
+	// Sum returns the hash of the bytes currently in the window
+	Sum() uint64
+}
+
+// blockRoller is implemented by the built-in RollingHashes so that scanners
+// can roll a whole block in a tight loop (instead of making an interface call
+// per byte). rollUntil rolls in the bytes of p, given the length of the segment
+// before p[0], until the cutter accepts a cut. It returns the number of bytes
+// consumed and whether a cut was found after the last of them.
+type blockRoller interface {
+	rollUntil(p []byte, length uint64, c *cutter) (int, bool)
+}
+
+// NewRollingHash returns the RollingHash used by the chunking algorithm
+func (a Algorithm) NewRollingHash(windowSize uint64) RollingHash {
+	switch a {
+	case AlgorithmRabinKarp:
+		return NewRabinKarp(windowSize)
+	case AlgorithmGear, AlgorithmFastCDC:
+		return NewGear()
+	default:
+		return NewBuzhash(windowSize)
+	}
+}
+
+// Buzhash is a cyclic polynomial rolling hash (github.com/kch42/buzhash)
+type Buzhash struct {
+	roller *buzhash.BuzHash
+}
+
+// NewBuzhash returns a buzhash RollingHash over windowSize bytes
+func NewBuzhash(windowSize uint64) *Buzhash {
+	return &Buzhash{roller: buzhash.NewBuzHash(uint32(windowSize))}
+}
+
+// Reset implements RollingHash
+func (b *Buzhash) Reset() { b.roller.Reset() }
+
+// Roll implements RollingHash
+func (b *Buzhash) Roll(c byte) uint64 { return uint64(b.roller.HashByte(c)) }
+
+// Sum implements RollingHash
+func (b *Buzhash) Sum() uint64 { return uint64(b.roller.Sum32()) }
+
+func (b *Buzhash) rollUntil(p []byte, length uint64, c *cutter) (int, bool) {
+	for i, x := range p {
+		if c.cut(uint64(b.roller.HashByte(x)), length+uint64(i)+1) {
+			return i + 1, true
+		}
+	}
+	return len(p), false
+}
+
+// rabinKarpPrime is the modulus of the Rabin-Karp polynomial (2^61 - 1)
+const rabinKarpPrime = (1 << 61) - 1
+
+// rabinKarpBase is the (arbitrary) base of the Rabin-Karp polynomial
+const rabinKarpBase = 0x1f3d5b79a2c4e687 % rabinKarpPrime
+
+// RabinKarp is a Rabin-Karp polynomial fingerprint over a window of bytes,
+// computed modulo the Mersenne prime 2^61-1
+type RabinKarp struct {
+	window []byte
+	pos    int
+	filled bool   // whether window has wrapped (i.e. bytes have to be removed)
+	outMul uint64 // base^len(window), to remove the byte leaving the window
+	sum    uint64
+}
+
+// NewRabinKarp returns a Rabin-Karp RollingHash over windowSize bytes
+func NewRabinKarp(windowSize uint64) *RabinKarp {
+	r := &RabinKarp{window: make([]byte, windowSize), outMul: 1}
+	for i := uint64(0); i < windowSize; i++ {
+		r.outMul = mulModPrime(r.outMul, rabinKarpBase)
+	}
+	return r
+}
+
+// Reset implements RollingHash
+func (r *RabinKarp) Reset() {
+	r.pos = 0
+	r.filled = false
+	r.sum = 0
+}
+
+// Roll implements RollingHash
+func (r *RabinKarp) Roll(b byte) uint64 {
+	// sum = sum*base + in - out*base^n (mod p). Bytes are offset by 1 so that
+	// runs of zeros don't hash to 0 (and match every mask).
+	sum := mulModPrime(r.sum, rabinKarpBase) + uint64(b) + 1
+	if r.filled {
+		sum += rabinKarpPrime - mulModPrime(uint64(r.window[r.pos])+1, r.outMul)
+	}
+	r.sum = sum % rabinKarpPrime
+
+	r.window[r.pos] = b
+	if r.pos++; r.pos == len(r.window) {
+		r.pos = 0
+		r.filled = true
+	}
+	return r.sum
+}
+
+// Sum implements RollingHash
+func (r *RabinKarp) Sum() uint64 { return r.sum }
+
+func (r *RabinKarp) rollUntil(p []byte, length uint64, c *cutter) (int, bool) {
+	for i, x := range p {
+		if c.cut(r.Roll(x), length+uint64(i)+1) {
+			return i + 1, true
+		}
+	}
+	return len(p), false
+}
+
+// mulModPrime returns a*b mod 2^61-1
+func mulModPrime(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	// a*b = hi*2^64 + lo = (hi<<3 | lo>>61)*2^61 + (lo & p) == ... + (lo & p) mod p
+	sum := (hi<<3 | lo>>61) + (lo & rabinKarpPrime)
+	if sum >= rabinKarpPrime {
+		sum -= rabinKarpPrime
+	}
+	return sum
+}
+
+// Gear is the gear hash used by FastCDC: sum = (sum << 1) + table[b]. Each
+// byte is shifted out after 64 more bytes, so the window is fixed at 64.
+type Gear struct {
+	sum uint64
+}
+
+// NewGear returns a gear RollingHash
+func NewGear() *Gear {
+	return &Gear{}
+}
+
+// Reset implements RollingHash
+func (g *Gear) Reset() { g.sum = 0 }
+
+// Roll implements RollingHash
+func (g *Gear) Roll(b byte) uint64 {
+	g.sum = (g.sum << 1) + gearTable[b]
+	return g.Sum()
+}
+
+// Sum implements RollingHash
+func (g *Gear) Sum() uint64 {
+	// the low bits only depend on the last few bytes, so hand out the high ones
+	return g.sum >> 32
+}
+
+func (g *Gear) rollUntil(p []byte, length uint64, c *cutter) (int, bool) {
+	sum := g.sum
+	for i, x := range p {
+		sum = (sum << 1) + gearTable[x]
+		if c.cut(sum>>32, length+uint64(i)+1) {
+			g.sum = sum
+			return i + 1, true
+		}
+	}
+	g.sum = sum
+	return len(p), false
+}
+
+// gearTable maps each byte to a random 64 bit value for the gear hash. It is
+// filled deterministically (splitmix64) so all deduplicators agree on it.
+var gearTable = func() (t [256]uint64) {
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
@@ -1,90 +1,390 @@
 package dedup
 
 import (
-	"bufio"
 	"io"
+	"math/bits"
 
-	"github.com/kch42/buzhash"
 	"github.com/pkg/errors"
 )
 
 // SegmentHandler is something capable of processing the segments handed to it
 type SegmentHandler func([]byte) error
 
-// Segmenter segments a file or stream
+// Algorithm identifies the content defined chunking algorithm used to find
+// segment boundaries
+type Algorithm uint8
+
+const (
+	// AlgorithmBuzhash cuts where the buzhash of the trailing window has all the
+	// Mask bits set to 0
+	AlgorithmBuzhash Algorithm = iota
+	// AlgorithmFastCDC cuts using a gear hash and normalized chunking (two masks
+	// that make cuts harder before the average size and easier after it)
+	AlgorithmFastCDC
+	// AlgorithmRabinKarp cuts where the Rabin-Karp fingerprint of the trailing
+	// window has all the Mask bits set to 0
+	AlgorithmRabinKarp
+	// AlgorithmGear cuts where the gear hash has all the Mask bits set to 0
+	AlgorithmGear
+)
+
+var algorithmNames = map[Algorithm]string{
+	AlgorithmBuzhash:   "buzhash",
+	AlgorithmFastCDC:   "fastcdc",
+	AlgorithmRabinKarp: "rabin",
+	AlgorithmGear:      "gear",
+}
+
+// String returns the name of the algorithm
+func (a Algorithm) String() string {
+	if name, ok := algorithmNames[a]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseAlgorithm returns the Algorithm with the given name
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for algo, n := range algorithmNames {
+		if n == name {
+			return algo, nil
+		}
+	}
+	return 0, errors.Errorf("Unknown chunking algorithm: %s", name)
+}
+
+// Segmenter segments a file or stream. Segments are never shorter than
+// MinSegmentLength (except at the end of the input) or longer than
+// MaxSegmentLength, and AvgSegmentLength (when set) derives the Mask.
 type Segmenter struct {
 	WindowSize       uint64
 	Mask             uint64
-	MaxSegmentLength uint64
-}
+	MaxSegmentLength uint64    // defaults to 8 * avg
+	MinSegmentLength uint64    // defaults to WindowSize (buzhash) or avg/4 (FastCDC)
+	AvgSegmentLength uint64    // defaults to Mask+1, must be a power of 2
+	Algorithm        Algorithm // defaults to AlgorithmBuzhash
 
-// SegmentFile does the actual work of segmenting the specified file as per the
-// params configure in the Segmenter struct. It reads the io.Reader till EOF,
-// calling the specified handler each time it finds a segment
-func (s Segmenter) SegmentFile(file io.Reader, handler SegmentHandler) error {
+	// NewRollingHash, if set, returns the RollingHash used in place of the
+	// Algorithm's (which still decides how cuts are made). The sum must only
+	// depend on the last WindowSize bytes rolled in, and streams don't record
+	// it, so the same hash must be used to segment the base of a patch.
+	NewRollingHash func() RollingHash
+}
 
-	if handler == nil {
-		return errors.Errorf("No segment handler specified")
+// NewSegmenter returns a Segmenter for the given algorithm that produces
+// segments of the given min, avg and max sizes (validated)
+func NewSegmenter(algo Algorithm, winsz, min, avg, max uint64) (Segmenter, error) {
+	s := Segmenter{
+		WindowSize:       winsz,
+		MinSegmentLength: min,
+		AvgSegmentLength: avg,
+		MaxSegmentLength: max,
+		Algorithm:        algo,
 	}
+	return s.normalize()
+}
+
+// Validate checks that the params configured in the Segmenter are usable
+func (s Segmenter) Validate() error {
+	_, err := s.normalize()
+	return err
+}
 
-	if s.Mask == 0 {
-		return errors.Errorf("Invalid mask specified (0)")
+// normalize returns a copy of the Segmenter with the defaults filled in, or an
+// error if the params are not usable
+func (s Segmenter) normalize() (Segmenter, error) {
+	if _, ok := algorithmNames[s.Algorithm]; !ok {
+		return s, errors.Errorf("Unknown chunking algorithm: %d", s.Algorithm)
 	}
 
 	if s.WindowSize <= 0 {
-		return errors.Errorf("Invalid windows size specified")
+		return s, errors.Errorf("Invalid windows size specified")
+	}
+
+	switch {
+	case s.AvgSegmentLength != 0:
+		if s.AvgSegmentLength&(s.AvgSegmentLength-1) != 0 {
+			return s, errors.Errorf("Invalid avg segment length (%d), must be a power of 2", s.AvgSegmentLength)
+		}
+		if s.Mask == 0 {
+			s.Mask = s.AvgSegmentLength - 1
+		} else if s.Mask != s.AvgSegmentLength-1 {
+			return s, errors.Errorf("Mask (%#x) conflicts with avg segment length (%d)", s.Mask, s.AvgSegmentLength)
+		}
+	case s.Mask == 0:
+		return s, errors.Errorf("Invalid mask specified (0)")
+	default:
+		s.AvgSegmentLength = s.Mask + 1
+	}
+	if s.Algorithm == AlgorithmFastCDC {
+		if s.AvgSegmentLength&s.Mask != 0 || s.AvgSegmentLength < 64 || s.AvgSegmentLength > 1<<30 {
+			return s, errors.Errorf("Invalid avg segment length (%d), FastCDC needs a power of 2 in [64, 1G]",
+				s.AvgSegmentLength)
+		}
 	}
 
+	if s.MinSegmentLength <= 0 {
+		if s.Algorithm == AlgorithmFastCDC {
+			s.MinSegmentLength = s.AvgSegmentLength / 4
+		} else {
+			s.MinSegmentLength = s.WindowSize
+		}
+	}
 	if s.MaxSegmentLength <= 0 {
-		s.MaxSegmentLength = (s.Mask + 1) * 8 // arbitrary :-)
+		s.MaxSegmentLength = s.AvgSegmentLength * 8 // arbitrary :-)
 	}
 
-	var (
-		reader     = bufio.NewReader(file)
-		roller     = buzhash.NewBuzHash(uint32(s.WindowSize))
-		curSegment = make([]byte, 0, s.MaxSegmentLength)
-		bytesRead  = uint64(0)
-		minSegLen  = s.WindowSize
-	)
+	if s.MinSegmentLength > s.AvgSegmentLength || s.AvgSegmentLength > s.MaxSegmentLength {
+		return s, errors.Errorf("Invalid segment lengths, need min (%d) <= avg (%d) <= max (%d)",
+			s.MinSegmentLength, s.AvgSegmentLength, s.MaxSegmentLength)
+	}
+
+	return s, nil
+}
+
+// SegmentFile does the actual work of segmenting the specified file as per the
+// params configure in the Segmenter struct. It reads the io.Reader till EOF,
+// calling the specified handler each time it finds a segment. The segment
+// handed to the handler is only valid until the handler returns.
+func (s Segmenter) SegmentFile(file io.Reader, handler SegmentHandler) error {
+
+	if handler == nil {
+		return errors.Errorf("No segment handler specified")
+	}
 
-	// Loop over input stream one byte at a time
+	segments := s.Segments(file)
 	for {
-		b, err := reader.ReadByte()
+		seg, err := segments.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
 			return err
 		}
+		if err := handler(seg.Data); err != nil {
+			return err
+		}
+	}
+}
 
-		curSegment = append(curSegment, b)
-		sum := roller.HashByte(b)
-		bytesRead++
+// Boundary describes why a segment ended where it did
+type Boundary uint8
 
-		// dont accept segments smaller than minSegLen
-		if uint64(len(curSegment)) < minSegLen {
-			continue
-		}
+const (
+	// BoundaryHash indicates the rolling hash matched the mask (a cut point)
+	BoundaryHash Boundary = iota
+	// BoundaryMaxLength indicates the segment was cut at MaxSegmentLength
+	BoundaryMaxLength
+	// BoundaryEOF indicates the input ended
+	BoundaryEOF
+)
+
+var boundaryNames = map[Boundary]string{
+	BoundaryHash:      "hash",
+	BoundaryMaxLength: "maxlength",
+	BoundaryEOF:       "eof",
+}
+
+// String returns the name of the boundary reason
+func (b Boundary) String() string {
+	if name, ok := boundaryNames[b]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Segment is a segment found in the input
+type Segment struct {
+	Offset   uint64   // Offset of the segment from the start of the input
+	Length   int      // Length of the segment
+	Data     []byte   // Data is only valid until the next call to Next
+	Boundary Boundary // Boundary is why the segment ended here
+}
+
+// SegmentIterator returns the segments in an input one at a time
+type SegmentIterator struct {
+	scanner *scanner
+	offset  uint64
+	err     error
+}
+
+// Segments returns an iterator over the segments in the input. The input is
+// only read as the segments are asked for.
+func (s Segmenter) Segments(input io.Reader) *SegmentIterator {
+	scanner, err := s.newScanner(input)
+	return &SegmentIterator{scanner: scanner, err: err}
+}
+
+// Next returns the next segment in the input, or io.EOF when there are no
+// more segments. Once an error is returned, all subsequent calls return it.
+func (it *SegmentIterator) Next() (Segment, error) {
+	if it.err != nil {
+		return Segment{}, it.err
+	}
+
+	data, boundary, err := it.scanner.next()
+	if err != nil {
+		it.err = err
+		return Segment{}, err
+	}
+
+	seg := Segment{Offset: it.offset, Length: len(data), Data: data, Boundary: boundary}
+	it.offset += uint64(len(data))
+	return seg, nil
+}
+
+// scanBlockSize is how much input the scanner tries to read at a time
+const scanBlockSize = 1 << 20
+
+// scanner finds the segments in an input stream. It reads the input in large
+// blocks and scans them in place, so the segments it returns are sub-slices of
+// its buffer (only the trailing partial segment is copied between blocks).
+type scanner struct {
+	input  io.Reader
+	roller RollingHash
+	cutter cutter
+	buf    []byte
+	start  int  // start (in buf) of the segment being scanned
+	pos    int  // next byte (in buf) to be rolled into the hash
+	end    int  // end of the valid data in buf
+	eof    bool // whether the input has been read till EOF
+}
+
+func (s Segmenter) newScanner(input io.Reader) (*scanner, error) {
+	s, err := s.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return &scanner{
+		input:  input,
+		roller: s.rollingHash(),
+		cutter: s.cutter(),
+		buf:    make([]byte, scanBlockSize+s.MaxSegmentLength),
+	}, nil
+}
+
+// rollingHash returns a new instance of the RollingHash used by the Segmenter
+func (s Segmenter) rollingHash() RollingHash {
+	if s.NewRollingHash != nil {
+		return s.NewRollingHash()
+	}
+	return s.Algorithm.NewRollingHash(s.WindowSize)
+}
 
-		// If this is a cutpoint, process the curSegment
-		if (uint64(sum) & s.Mask) == 0 {
-			if err := handler(curSegment); err != nil {
-				return err
+// next returns the next segment in the input (and why it ended there), or
+// io.EOF once all of it has been returned. The segment is only valid until the
+// next call to next.
+func (sc *scanner) next() ([]byte, Boundary, error) {
+	for {
+		if sc.roll() {
+			seg := sc.buf[sc.start:sc.pos]
+			sc.start = sc.pos
+			if sc.cutter.forced(sc.roller.Sum(), uint64(len(seg))) {
+				return seg, BoundaryMaxLength, nil
 			}
-			curSegment = curSegment[:0] // reset the curSegment accumulator
+			return seg, BoundaryHash, nil
 		}
-		if uint64(len(curSegment)) >= s.MaxSegmentLength {
-			if err := handler(curSegment); err != nil {
-				return err
+
+		if sc.eof {
+			if sc.start == sc.end {
+				return nil, BoundaryEOF, io.EOF
 			}
-			curSegment = curSegment[:0] // reset the curSegment accumulator
+			// whatever is left over is the last segment
+			seg := sc.buf[sc.start:sc.end]
+			sc.start = sc.end
+			return seg, BoundaryEOF, nil
+		}
+
+		if err := sc.fill(); err != nil {
+			return nil, BoundaryEOF, err
+		}
+	}
+}
+
+// roll rolls the unscanned bytes in buf into the hash until a cut is found,
+// returning whether one was (in which case pos is just past the cut)
+func (sc *scanner) roll() bool {
+	length := uint64(sc.pos - sc.start)
+	if br, ok := sc.roller.(blockRoller); ok {
+		n, found := br.rollUntil(sc.buf[sc.pos:sc.end], length, &sc.cutter)
+		sc.pos += n
+		return found
+	}
+
+	for ; sc.pos < sc.end; sc.pos++ {
+		length++
+		if sc.cutter.cut(sc.roller.Roll(sc.buf[sc.pos]), length) {
+			sc.pos++
+			return true
 		}
 	}
+	return false
+}
+
+// fill moves the partial segment to the front of the buffer and reads more
+// input after it
+func (sc *scanner) fill() error {
+	if sc.start > 0 {
+		copy(sc.buf, sc.buf[sc.start:sc.end])
+		sc.pos -= sc.start
+		sc.end -= sc.start
+		sc.start = 0
+	}
+
+	n, err := sc.input.Read(sc.buf[sc.end:])
+	sc.end += n
+	if err == io.EOF {
+		sc.eof = true
+		return nil
+	}
+	return err
+}
+
+// cutter decides whether to end a segment, given its length and the rolling
+// hash of its last byte
+type cutter struct {
+	min   uint64
+	avg   uint64
+	max   uint64
+	maskS uint64 // mask tested when the segment is shorter than avg
+	maskL uint64 // mask tested when the segment is avg or longer
+}
 
-	// Deal with any remaining bytes in curSegment
-	if err := handler(curSegment); err != nil {
-		return err
+// cutter returns the cutter for the (normalized) Segmenter. All algorithms cut
+// where the hash has all of the mask bits set to 0, but FastCDC normalizes the
+// segment lengths by using a stricter mask before the avg length is reached and
+// a looser one after (see "FastCDC", Xia et al, USENIX ATC '16).
+func (s Segmenter) cutter() cutter {
+	c := cutter{
+		min:   s.MinSegmentLength,
+		avg:   s.AvgSegmentLength,
+		max:   s.MaxSegmentLength,
+		maskS: s.Mask,
+		maskL: s.Mask,
+	}
+	if s.Algorithm == AlgorithmFastCDC {
+		avgBits := uint(bits.Len64(s.AvgSegmentLength) - 1)
+		c.maskS = uint64(1)<<(avgBits+2) - 1
+		c.maskL = uint64(1)<<(avgBits-2) - 1
 	}
+	return c
+}
 
-	return nil
+// forced returns whether a cut made at the given length was only made because
+// the max length was reached (i.e. the hash would not have permitted it)
+func (c *cutter) forced(sum, length uint64) bool {
+	return length >= c.max && sum&c.maskL != 0
+}
+
+func (c *cutter) cut(sum, length uint64) bool {
+	switch {
+	case length < c.min:
+		return false // dont accept segments smaller than min
+	case length >= c.max:
+		return true
+	case length < c.avg:
+		return sum&c.maskS == 0
+	default:
+		return sum&c.maskL == 0
+	}
 }
@@ -0,0 +1,250 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testInput returns size bytes of (seeded) random data, with stretches of it
+// repeated and a run of zeroes so that there's something to dedup and some
+// segments are cut at the max length
+func testInput(size int, seed int64) []byte {
+	rng := rand.New(rand.NewSource(seed))
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		n := 1 + rng.Intn(64<<10)
+		switch {
+		case len(data) > n && rng.Intn(3) == 0:
+			start := rng.Intn(len(data) - n)
+			data = append(data, data[start:start+n]...)
+		case rng.Intn(20) == 0:
+			data = append(data, make([]byte, n)...)
+		default:
+			chunk := make([]byte, n)
+			rng.Read(chunk)
+			data = append(data, chunk...)
+		}
+	}
+	return data[:size]
+}
+
+// testSegmenter returns a Segmenter (for the algorithm) that makes small
+// segments, so tests see plenty of them
+func testSegmenter(t testing.TB, algo Algorithm) Segmenter {
+	s, err := NewSegmenter(algo, 64, 0, 4096, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var algorithms = []Algorithm{AlgorithmBuzhash, AlgorithmFastCDC, AlgorithmRabinKarp, AlgorithmGear}
+
+// segmentsOf returns (copies of) the segments SegmentFile finds in data
+func segmentsOf(t testing.TB, s Segmenter, data []byte) [][]byte {
+	segs := [][]byte{}
+	err := s.SegmentFile(bytes.NewReader(data), func(seg []byte) error {
+		segs = append(segs, append([]byte{}, seg...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segs
+}
+
+func TestSegments(t *testing.T) {
+	// the tail is shorter than the min segment length, so the input can't end
+	// on a cut
+	data := append(testInput(3<<20, 1), bytes.Repeat([]byte{0x5a}, 100)...)
+
+	for _, algo := range algorithms {
+		t.Run(algo.String(), func(t *testing.T) {
+			s := testSegmenter(t, algo)
+			var (
+				it     = s.Segments(bytes.NewReader(data))
+				offset = uint64(0)
+				last   = Segment{}
+				count  = 0
+			)
+			for {
+				seg, err := it.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if last.Boundary == BoundaryEOF && count > 0 {
+					t.Fatalf("Segment %d follows one that ended at EOF", count)
+				}
+
+				if seg.Offset != offset {
+					t.Fatalf("Segment %d at offset %d, expected %d", count, seg.Offset, offset)
+				}
+				if seg.Length != len(seg.Data) {
+					t.Fatalf("Segment %d has length %d but %d bytes", count, seg.Length, len(seg.Data))
+				}
+				if !bytes.Equal(seg.Data, data[offset:offset+uint64(seg.Length)]) {
+					t.Fatalf("Segment %d doesn't match the input at offset %d", count, offset)
+				}
+				if uint64(seg.Length) > s.MaxSegmentLength {
+					t.Fatalf("Segment %d is %d bytes, longer than the max (%d)", count, seg.Length, s.MaxSegmentLength)
+				}
+				switch seg.Boundary {
+				case BoundaryHash:
+					if uint64(seg.Length) < s.MinSegmentLength {
+						t.Fatalf("Segment %d is %d bytes, shorter than the min (%d)", count, seg.Length, s.MinSegmentLength)
+					}
+				case BoundaryMaxLength:
+					if uint64(seg.Length) != s.MaxSegmentLength {
+						t.Fatalf("Segment %d was cut at the max length, but is %d bytes", count, seg.Length)
+					}
+				}
+
+				offset += uint64(seg.Length)
+				last = seg
+				count++
+			}
+
+			if offset != uint64(len(data)) {
+				t.Fatalf("Segments add up to %d bytes, input is %d", offset, len(data))
+			}
+			if last.Boundary != BoundaryEOF {
+				t.Fatalf("Last segment ended at %s, expected %s", last.Boundary, BoundaryEOF)
+			}
+			if _, err := it.Next(); err != io.EOF {
+				t.Fatalf("Expected io.EOF after the last segment, got %v", err)
+			}
+			if segs := segmentsOf(t, s, data); len(segs) != count {
+				t.Fatalf("SegmentFile found %d segments, Segments found %d", len(segs), count)
+			}
+		})
+	}
+}
+
+func TestSegmentsEmptyInput(t *testing.T) {
+	seg, err := testSegmenter(t, AlgorithmBuzhash).Segments(bytes.NewReader(nil)).Next()
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got segment %+v (err %v)", seg, err)
+	}
+}
+
+func TestSegmentsInvalidParams(t *testing.T) {
+	s := Segmenter{WindowSize: 64, Mask: 0xfff, Algorithm: AlgorithmFastCDC, MinSegmentLength: 8192}
+	if _, err := s.Segments(bytes.NewReader([]byte("data"))).Next(); err == nil || err == io.EOF {
+		t.Fatalf("Expected an error for min > avg, got %v", err)
+	}
+}
+
+func TestCustomRollingHash(t *testing.T) {
+	data := testInput(1<<20, 2)
+	s := testSegmenter(t, AlgorithmBuzhash)
+	custom := s
+
+	// Buzhash is a blockRoller, the wrapper hides that so the generic path is
+	// taken (and must find the same cuts)
+	custom.NewRollingHash = func() RollingHash { return struct{ RollingHash }{NewBuzhash(s.WindowSize)} }
+	want, got := segmentsOf(t, s, data), segmentsOf(t, custom, data)
+	if len(got) != len(want) {
+		t.Fatalf("Custom hash found %d segments, expected %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("Segment %d differs", i)
+		}
+	}
+}
+
+// segmentPerByte is the segmenting loop SegmentFile had before it scanned
+// blocks: it reads the input a byte at a time, rolls each byte into the hash
+// and appends it to the current segment. It is kept as the baseline for
+// BenchmarkSegmentFile.
+func segmentPerByte(s Segmenter, file io.Reader, handler SegmentHandler) error {
+	s, err := s.normalize()
+	if err != nil {
+		return err
+	}
+	var (
+		reader     = bufio.NewReader(file)
+		roller     = s.rollingHash()
+		cutter     = s.cutter()
+		curSegment = make([]byte, 0, s.MaxSegmentLength)
+	)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		curSegment = append(curSegment, b)
+		if cutter.cut(roller.Roll(b), uint64(len(curSegment))) {
+			if err := handler(curSegment); err != nil {
+				return err
+			}
+			curSegment = curSegment[:0]
+		}
+	}
+	if len(curSegment) == 0 {
+		return nil
+	}
+	return handler(curSegment)
+}
+
+func TestSegmentPerByte(t *testing.T) {
+	data := testInput(1<<20, 4)
+	for _, algo := range algorithms {
+		s := testSegmenter(t, algo)
+		want, got := segmentsOf(t, s, data), [][]byte{}
+		err := segmentPerByte(s, bytes.NewReader(data), func(seg []byte) error {
+			got = append(got, append([]byte{}, seg...))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s: the per-byte loop found %d segments, expected %d", algo, len(got), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Fatalf("%s: segment %d differs", algo, i)
+			}
+		}
+	}
+}
+
+// BenchmarkSegmentFile compares SegmentFile with the per-byte loop it replaced
+// (e.g. go test -bench SegmentFile -benchtime 5x)
+func BenchmarkSegmentFile(b *testing.B) {
+	data := testInput(256<<20, 3)
+	for _, algo := range algorithms {
+		s, err := NewSegmenter(algo, 64, 0, 8192, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		impls := []struct {
+			name    string
+			segment func(io.Reader, SegmentHandler) error
+		}{
+			{"block", s.SegmentFile},
+			{"perbyte", func(r io.Reader, h SegmentHandler) error { return segmentPerByte(s, r, h) }},
+		}
+		for _, impl := range impls {
+			b.Run(algo.String()+"/"+impl.name, func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					err := impl.segment(bytes.NewReader(data), func([]byte) error { return nil })
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package dedup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+
+	"github.com/amoghe/dedup/codec"
+	"github.com/pkg/errors"
+)
+
+// Signature describes the segments of a (base) file, so that patches against
+// it can be made without the file itself (see Differ.MakePatchFromSignature)
+type Signature struct {
+	// Header holds the chunker params that produced the segments, and the
+	// size and digest of the base file
+	Header   codec.Header
+	Segments []SignatureSegment
+}
+
+// SignatureSegment describes a segment of the base file
+type SignatureSegment struct {
+	Hash   []byte // SHA-512 of the segment
+	Offset uint64 // offset of the segment in the base file
+	Length uint64
+}
+
+// signatureIndex maps segment hashes to (the first occurrence of) the segment
+// in the base file
+type signatureIndex map[string]SignatureSegment
+
+// MakeSignature returns the Signature of the old file, segmented as per the
+// Differ's options
+func (d *Differ) MakeSignature(old io.Reader) (*Signature, error) {
+	return d.MakeSignatureContext(context.Background(), old)
+}
+
+// MakeSignatureContext is MakeSignature, but gives up (returning ctx.Err())
+// once ctx is done
+func (d *Differ) MakeSignatureContext(ctx context.Context, old io.Reader) (*Signature, error) {
+	segmenter, err := d.dedup.segmenter.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sig    = &Signature{}
+		digest = newStreamDigest()
+	)
+	err = d.dedup.segment(ctx, old, func(seg, seghash []byte) error {
+		sig.Segments = append(sig.Segments, SignatureSegment{
+			Hash:   append([]byte{}, seghash...),
+			Offset: digest.total,
+			Length: uint64(len(seg)),
+		})
+		digest.Write(seg)
+		return nil
+	})
+	if err != nil {
+		return nil, contextErr(ctx, errors.Wrapf(err, "Failed to segment old file"))
+	}
+
+	base := digest.trailer()
+	sig.Header = d.dedup.header(segmenter)
+	sig.Header.Flags = codec.FlagSignature
+	sig.Header.LRUSegments, sig.Header.LRUBytes = 0, 0
+	sig.Header.BaseSize = base.TotalBytes
+	sig.Header.BaseDigest = base.Digest
+	return sig, nil
+}
+
+// WriteSignature writes the signature to the output. It is laid out as a
+// header (with FlagSignature) followed by the number of segments, and the
+// length (uvarint) and hash of each segment, in order.
+func WriteSignature(output io.Writer, sig *Signature) error {
+	buffered := bufio.NewWriter(output)
+	if err := codec.WriteHeader(buffered, sig.Header); err != nil {
+		return err
+	}
+
+	var v [binary.MaxVarintLen64]byte
+	buffered.Write(v[:binary.PutUvarint(v[:], uint64(len(sig.Segments)))])
+	for _, seg := range sig.Segments {
+		buffered.Write(v[:binary.PutUvarint(v[:], seg.Length)])
+		buffered.Write(seg.Hash)
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return errors.Wrapf(err, "Failed to write signature")
+	}
+	return nil
+}
+
+// ReadSignature reads a signature (written by WriteSignature) from the input
+func ReadSignature(input io.Reader) (*Signature, error) {
+	buffered := bufio.NewReader(input)
+	header, err := codec.ReadHeader(buffered)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid signature header")
+	}
+	if header.Flags&codec.FlagSignature == 0 {
+		return nil, errors.Errorf("Not a signature")
+	}
+
+	count, err := binary.ReadUvarint(buffered)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read signature")
+	}
+
+	sig := &Signature{Header: header}
+	offset := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(buffered)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read signature")
+		}
+		hash := make([]byte, sha512.Size)
+		if _, err := io.ReadFull(buffered, hash); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read signature")
+		}
+		sig.Segments = append(sig.Segments, SignatureSegment{Hash: hash, Offset: offset, Length: length})
+		offset += length
+	}
+	if offset != header.BaseSize {
+		return nil, errors.Errorf("Invalid signature: segments cover %d bytes, expected %d",
+			offset, header.BaseSize)
+	}
+	return sig, nil
+}
+
+// MakePatchFromSignature writes a patch between the file described by sig and
+// "new" to the output. Segments of "new" that are in the old file are written
+// as Copy messages (ranges of the old file), so ApplyPatch needs random access
+// (an io.ReaderAt) to the old file to apply the patch. "new" is segmented with
+// the chunker params recorded in the signature.
+func (d *Differ) MakePatchFromSignature(sig *Signature, new io.Reader, out io.Writer) error {
+	return d.MakePatchFromSignatureContext(context.Background(), sig, new, out)
+}
+
+// MakePatchFromSignatureContext is MakePatchFromSignature, but gives up
+// (returning ctx.Err()) once ctx is done
+func (d *Differ) MakePatchFromSignatureContext(ctx context.Context, sig *Signature, new io.Reader, out io.Writer) error {
+	// new is segmented as the old file was
+	dedup, err := d.deduplicatorFor(sig.Header)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid signature")
+	}
+	defer dedup.Close()
+
+	index := make(signatureIndex, len(sig.Segments))
+	for _, seg := range sig.Segments {
+		if _, there := index[string(seg.Hash)]; !there {
+			index[string(seg.Hash)] = seg
+		}
+	}
+
+	dedup.sig = index
+	dedup.base = &codec.Message{TotalBytes: sig.Header.BaseSize, Digest: sig.Header.BaseDigest}
+	if err := dedup.DoContext(ctx, new, out); err != nil {
+		return contextErr(ctx, errors.Wrapf(err, "Failed to segment new file"))
+	}
+	return nil
+}
+
+// emitCopy writes a Copy of the segment (known to be in the base file)
+func (d *Deduplicator) emitCopy(writer codec.Writer, seg []byte, known SignatureSegment) error {
+	if d.checksums {
+		d.digest.Write(seg)
+	}
+	msg := codec.Message{Type: codec.MessageCopy, Offset: known.Offset, Length: known.Length}
+	if err := writer.Write(&msg); err != nil {
+		return err
+	}
+
+	d.progress.BytesIn += uint64(len(seg))
+	d.progress.Segments++
+	d.progress.DupSegments++
+	d.progress.DupBytes += uint64(len(seg))
+	d.report()
+	return nil
+}
+
+// copyCoalescer is a codec.Writer that merges runs of Copy messages for
+// adjacent ranges of the base file into a single Copy
+type copyCoalescer struct {
+	writer  codec.Writer
+	pending codec.Message // Copy being extended (if Length > 0)
+}
+
+func (c *copyCoalescer) Write(msg *codec.Message) error {
+	if msg.Type == codec.MessageCopy {
+		if c.pending.Length > 0 && c.pending.Offset+c.pending.Length == msg.Offset {
+			c.pending.Length += msg.Length
+			return nil
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		c.pending = *msg
+		return nil
+	}
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.writer.Write(msg)
+}
+
+// flush writes the pending Copy (if any)
+func (c *copyCoalescer) flush() error {
+	if c.pending.Length == 0 {
+		return nil
+	}
+	msg := c.pending
+	c.pending = codec.Message{}
+	return c.writer.Write(&msg)
+}
@@ -0,0 +1,60 @@
+package dedup
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeSignature returns the signature of data, as written by WriteSignature
+func writeSignature(t *testing.T, s Segmenter, data []byte) (*Signature, []byte) {
+	sig, err := testDiffer(t, s).MakeSignature(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := bytes.Buffer{}
+	if err := WriteSignature(&written, sig); err != nil {
+		t.Fatal(err)
+	}
+	return sig, written.Bytes()
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	data := testInput(1<<20, 40)
+	for _, algo := range algorithms {
+		sig, written := writeSignature(t, testSegmenter(t, algo), data)
+		if len(sig.Segments) < 2 {
+			t.Fatalf("%s: the signature has %d segments", algo, len(sig.Segments))
+		}
+		got, err := ReadSignature(bytes.NewReader(written))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, sig) {
+			t.Fatalf("%s: read %+v, expected %+v", algo, got.Header, sig.Header)
+		}
+	}
+}
+
+func TestReadSignatureTruncated(t *testing.T) {
+	_, written := writeSignature(t, testSegmenter(t, AlgorithmFastCDC), testInput(1<<20, 41))
+	for _, n := range []int{0, 10, len(written) / 2, len(written) - 1} {
+		if _, err := ReadSignature(bytes.NewReader(written[:n])); err == nil {
+			t.Fatalf("Signature truncated to %d of %d bytes was read", n, len(written))
+		}
+	}
+}
+
+func TestReadSignatureLengthMismatch(t *testing.T) {
+	sig, _ := writeSignature(t, testSegmenter(t, AlgorithmGear), testInput(1<<20, 42))
+	sig.Segments[len(sig.Segments)/2].Length++
+	written := bytes.Buffer{}
+	if err := WriteSignature(&written, sig); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ReadSignature(&written)
+	if err == nil || !strings.Contains(err.Error(), "segments cover") {
+		t.Fatalf("Expected a length mismatch error, got %v", err)
+	}
+}
@@ -22,22 +22,37 @@ type SegmentStat struct {
 	Freq   int    // How many times this segment occurred in the file
 }
 
-// SegmentTracker tracks segments
+// Tracker tracks the segments seen by a Deduplicator, assigning an ID to each
+// unique segment (identified by its hash) and counting how often it occurs
+type Tracker interface {
+	// Track records an occurrence of the segment and returns its stats
+	Track(segment, seghash []byte) (SegmentStat, error)
+	// Forget drops the segment, if it is seen again it is given a new ID
+	Forget(seghash []byte) error
+	// PrintStats prints stats about the tracked segments to out
+	PrintStats(out io.Writer) error
+	// Close releases any resources (e.g. files) held by the tracker
+	Close() error
+}
+
+// SegmentTracker tracks segments (in memory)
 type SegmentTracker struct {
 	SegHashes map[string]SegmentStat // map[crypto hash of seg] -> SegmentStat
 	// internal - tracks IDs we've issued to segments
 	segmentNum uint64
+	forgotten  forgottenStats
 }
 
 // NewSegmentTracker returns an initialized SegmentTracker struct
 func NewSegmentTracker() *SegmentTracker {
 	return &SegmentTracker{
 		SegHashes: make(map[string]SegmentStat),
+		forgotten: forgottenStats{},
 	}
 }
 
 // Track records the stats for the specified segment
-func (s *SegmentTracker) Track(segment, seghash []byte) SegmentStat {
+func (s *SegmentTracker) Track(segment, seghash []byte) (SegmentStat, error) {
 
 	// Sprint'ing the hash sum causes an unnecessary/avoidable allocation
 	//segHash := fmt.Sprintf("%X", s.segHasher.Sum(segment))
@@ -51,11 +66,57 @@ func (s *SegmentTracker) Track(segment, seghash []byte) SegmentStat {
 		segStat.ID = atomic.AddUint64(&s.segmentNum, 1)
 	}
 	s.SegHashes[segHash] = segStat
-	return segStat
+	return segStat, nil
+}
+
+// Forget drops the specified segment, its stats still count towards those
+// printed by PrintStats
+func (s *SegmentTracker) Forget(seghash []byte) error {
+	if stat, there := s.SegHashes[string(seghash)]; there {
+		if s.forgotten == nil {
+			s.forgotten = forgottenStats{}
+		}
+		s.forgotten.add(stat)
+		delete(s.SegHashes, string(seghash))
+	}
+	return nil
+}
+
+// Close implements Tracker (there is nothing to release)
+func (s *SegmentTracker) Close() error {
+	return nil
 }
 
 // PrintStats prints the segment stats on the given output (io.Writer)
 func (s SegmentTracker) PrintStats(out io.Writer) error {
+	return printStats(out, func(visit func(SegmentStat)) error {
+		for _, stat := range s.SegHashes {
+			visit(stat)
+		}
+		s.forgotten.forEach(visit)
+		return nil
+	})
+}
+
+// forgottenStats holds the stats of the segments a Tracker has forgotten (so
+// they still count towards the totals), as the number of segments that had
+// each (length, frequency)
+type forgottenStats map[SegmentStat]int
+
+func (f forgottenStats) add(stat SegmentStat) {
+	f[SegmentStat{Length: stat.Length, Freq: stat.Freq}]++
+}
+
+func (f forgottenStats) forEach(visit func(SegmentStat)) {
+	for stat, n := range f {
+		for i := 0; i < n; i++ {
+			visit(stat)
+		}
+	}
+}
+
+// printStats prints stats about the segments visited by forEach to out
+func printStats(out io.Writer, forEach func(func(SegmentStat)) error) error {
 
 	var (
 		mostFreq  = 0
@@ -63,9 +124,9 @@ func (s SegmentTracker) PrintStats(out io.Writer) error {
 		dupBytes  = 0
 		lenUnique = uint64(0)
 		lenTotal  = uint64(0)
-		segLens   = make([]float64, 0, len(s.SegHashes))
+		segLens   = []float64{}
 	)
-	for _, stat := range s.SegHashes {
+	err := forEach(func(stat SegmentStat) {
 		if stat.Freq <= 0 {
 			log.Panicln("Found SegmentStat with Freq = 0")
 		}
@@ -81,6 +142,9 @@ func (s SegmentTracker) PrintStats(out io.Writer) error {
 		}
 		lenUnique += uint64(stat.Length)
 		lenTotal += uint64(stat.Length) * uint64(stat.Freq)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to gather segment stats")
 	}
 
 	med, err := stats.Median(segLens)
@@ -0,0 +1,174 @@
+package dedup
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// SegmentStore holds the bytes of the segments defined so far in a stream, so
+// that a Reduplicator can look them up when they are referenced
+type SegmentStore interface {
+	// Put stores the bytes of the segment with the given ID
+	Put(id uint64, seg []byte) error
+	// Get returns the bytes of the segment with the given ID, and whether
+	// there is such a segment
+	Get(id uint64) ([]byte, bool, error)
+	// Delete drops the segment with the given ID (it won't be referenced again)
+	Delete(id uint64) error
+	// Close releases any resources (e.g. files) held by the store
+	Close() error
+}
+
+// MemoryStore is a SegmentStore that keeps all the segments in memory
+type MemoryStore map[uint64][]byte
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() MemoryStore {
+	return MemoryStore{}
+}
+
+// Put implements SegmentStore
+func (m MemoryStore) Put(id uint64, seg []byte) error {
+	m[id] = seg
+	return nil
+}
+
+// Get implements SegmentStore
+func (m MemoryStore) Get(id uint64) ([]byte, bool, error) {
+	seg, there := m[id]
+	return seg, there, nil
+}
+
+// Delete implements SegmentStore
+func (m MemoryStore) Delete(id uint64) error {
+	delete(m, id)
+	return nil
+}
+
+// Close implements SegmentStore (there is nothing to release)
+func (m MemoryStore) Close() error { return nil }
+
+// SpillStore is a SegmentStore that keeps up to budget bytes of the most
+// recently used segments in memory, and spills the rest to a temporary file
+// from which they are read back when referenced. Segments never change once
+// defined, so a segment is written to the file at most once.
+type SpillStore struct {
+	budget  int64
+	used    int64
+	dir     string
+	lru     *list.List               // of *spillEntry, most recently used first
+	inMem   map[uint64]*list.Element // segments held in memory
+	spilled map[uint64]spillExtent   // segments written to the file
+	file    *os.File
+	fileLen int64
+}
+
+type spillEntry struct {
+	id  uint64
+	seg []byte
+}
+
+type spillExtent struct {
+	off    int64
+	length int
+}
+
+// NewSpillStore returns a SpillStore that keeps (roughly) at most budget bytes
+// of segments in memory, spilling the rest to a temporary file in dir (or the
+// default temp dir, if dir is ""). Close removes the file.
+func NewSpillStore(budget int64, dir string) *SpillStore {
+	return &SpillStore{
+		budget:  budget,
+		dir:     dir,
+		lru:     list.New(),
+		inMem:   map[uint64]*list.Element{},
+		spilled: map[uint64]spillExtent{},
+	}
+}
+
+// Put implements SegmentStore
+func (s *SpillStore) Put(id uint64, seg []byte) error {
+	if elem, there := s.inMem[id]; there {
+		s.used -= int64(len(elem.Value.(*spillEntry).seg))
+		s.lru.Remove(elem)
+	}
+	s.inMem[id] = s.lru.PushFront(&spillEntry{id: id, seg: seg})
+	s.used += int64(len(seg))
+	return s.evict()
+}
+
+// Get implements SegmentStore
+func (s *SpillStore) Get(id uint64) ([]byte, bool, error) {
+	if elem, there := s.inMem[id]; there {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*spillEntry).seg, true, nil
+	}
+
+	extent, there := s.spilled[id]
+	if !there {
+		return nil, false, nil
+	}
+	seg := make([]byte, extent.length)
+	if _, err := s.file.ReadAt(seg, extent.off); err != nil {
+		return nil, false, errors.Wrapf(err, "Failed to read spilled segment %d", id)
+	}
+
+	// page it back in, it is likely to be referenced again
+	s.inMem[id] = s.lru.PushFront(&spillEntry{id: id, seg: seg})
+	s.used += int64(len(seg))
+	return seg, true, s.evict()
+}
+
+// Delete implements SegmentStore. The space the segment used in the spill file
+// (if any) is not reclaimed.
+func (s *SpillStore) Delete(id uint64) error {
+	if elem, there := s.inMem[id]; there {
+		s.used -= int64(len(elem.Value.(*spillEntry).seg))
+		s.lru.Remove(elem)
+		delete(s.inMem, id)
+	}
+	delete(s.spilled, id)
+	return nil
+}
+
+// evict spills the least recently used segments till we're within budget
+func (s *SpillStore) evict() error {
+	for s.used > s.budget && s.lru.Len() > 0 {
+		entry := s.lru.Remove(s.lru.Back()).(*spillEntry)
+		delete(s.inMem, entry.id)
+		s.used -= int64(len(entry.seg))
+
+		if _, there := s.spilled[entry.id]; there {
+			continue
+		}
+		if s.file == nil {
+			f, err := ioutil.TempFile(s.dir, "dedup-spill-")
+			if err != nil {
+				return errors.Wrapf(err, "Failed to create spill file")
+			}
+			s.file = f
+		}
+		if _, err := s.file.WriteAt(entry.seg, s.fileLen); err != nil {
+			return errors.Wrapf(err, "Failed to spill segment %d", entry.id)
+		}
+		s.spilled[entry.id] = spillExtent{off: s.fileLen, length: len(entry.seg)}
+		s.fileLen += int64(len(entry.seg))
+	}
+	return nil
+}
+
+// Close implements SegmentStore, removing the spill file
+func (s *SpillStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	return os.Remove(name)
+}
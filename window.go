@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"container/list"
+
+	"github.com/amoghe/dedup/codec"
+)
+
+// segmentWindow tracks the most recently used segments, so that a
+// Deduplicator can forget the ones that fall out of the window (and tell the
+// Reduplicator to do the same). This bounds the memory used on both ends.
+type segmentWindow struct {
+	maxSegments int
+	maxBytes    int64
+	bytes       int64
+	lru         *list.List               // of *windowEntry, most recent first
+	entries     map[string]*list.Element // by segment hash
+}
+
+type windowEntry struct {
+	seghash string
+	id      uint64
+	length  int
+}
+
+func newSegmentWindow(maxSegments int, maxBytes int64) *segmentWindow {
+	return &segmentWindow{
+		maxSegments: maxSegments,
+		maxBytes:    maxBytes,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+	}
+}
+
+// touch records a use of the segment, and returns the segments (least recently
+// used first) that have fallen out of the window as a result
+func (w *segmentWindow) touch(seghash []byte, stat SegmentStat) []*windowEntry {
+	if elem, there := w.entries[string(seghash)]; there {
+		w.lru.MoveToFront(elem)
+		return nil
+	}
+
+	entry := &windowEntry{seghash: string(seghash), id: stat.ID, length: stat.Length}
+	w.entries[entry.seghash] = w.lru.PushFront(entry)
+	w.bytes += int64(stat.Length)
+
+	evicted := []*windowEntry{}
+	for w.full() {
+		entry := w.lru.Remove(w.lru.Back()).(*windowEntry)
+		delete(w.entries, entry.seghash)
+		w.bytes -= int64(entry.length)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+func (w *segmentWindow) full() bool {
+	if w.lru.Len() == 0 {
+		return false
+	}
+	return (w.maxSegments > 0 && w.lru.Len() > w.maxSegments) ||
+		(w.maxBytes > 0 && w.bytes > w.maxBytes)
+}
+
+// forget has the tracker forget the segments that fell out of the window, and
+// writes Forget messages for them
+func (d *Deduplicator) forget(writer codec.Writer, evicted []*windowEntry) error {
+	for _, entry := range evicted {
+		if err := d.tracker.Forget([]byte(entry.seghash)); err != nil {
+			return err
+		}
+		msg := codec.Message{Type: codec.MessageForget, RefID: entry.id}
+		if err := writer.Write(&msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
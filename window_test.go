@@ -0,0 +1,73 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLRUWindowRoundTrip(t *testing.T) {
+	data := testInput(4<<20, 9)
+	windows := map[string]Options{
+		"segments": {LRUSegments: 5},
+		"bytes":    {LRUBytes: 256 << 10},
+	}
+
+	for name, opts := range windows {
+		t.Run(name, func(t *testing.T) {
+			opts.Segmenter = testSegmenter(t, AlgorithmBuzhash)
+			opts.Checksums = true
+			d, err := NewDeduplicatorWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			deduped := bytes.Buffer{}
+			if err := d.Do(bytes.NewReader(data), &deduped); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReduplicator()
+			defer r.Close()
+			output := bytes.Buffer{}
+			if err := r.Do(bytes.NewReader(deduped.Bytes()), &output); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(output.Bytes(), data) {
+				t.Fatalf("Reduplicated %d bytes don't match the %d bytes of input", output.Len(), len(data))
+			}
+			if r.forgetCount == 0 {
+				t.Fatalf("Nothing fell out of the window")
+			}
+
+			// the stats cover the segments that were forgotten too
+			stats := struct {
+				NumSegments int
+				DupSegCount int
+				DupBytes    int
+				UniqueBytes uint64
+				TotalBytes  uint64
+			}{}
+			printed := bytes.Buffer{}
+			if err := d.PrintStats(&printed); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(printed.Bytes(), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if segs := segmentsOf(t, opts.Segmenter, data); stats.NumSegments != len(segs) {
+				t.Errorf("NumSegments is %d, expected %d", stats.NumSegments, len(segs))
+			}
+			if stats.TotalBytes != uint64(len(data)) {
+				t.Errorf("TotalBytes is %d, expected %d", stats.TotalBytes, len(data))
+			}
+			if stats.UniqueBytes != r.defBytes || uint64(stats.DupBytes) != r.refBytes {
+				t.Errorf("UniqueBytes/DupBytes are %d/%d, the stream has %d/%d",
+					stats.UniqueBytes, stats.DupBytes, r.defBytes, r.refBytes)
+			}
+			if uint64(stats.DupSegCount) != r.refCount {
+				t.Errorf("DupSegCount is %d, the stream has %d refs", stats.DupSegCount, r.refCount)
+			}
+		})
+	}
+}
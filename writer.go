@@ -0,0 +1,64 @@
+package dedup
+
+import (
+	"io"
+)
+
+// Writer is an io.WriteCloser that deduplicates whatever is written to it,
+// writing the dedup stream to the underlying writer. It lets a Deduplicator be
+// used in the middle of a writer chain (e.g. tar.Writer -> dedup -> gzip).
+type Writer struct {
+	dedup *Deduplicator
+	pipe  *io.PipeWriter
+	done  chan error // receives the result of the Deduplicator
+
+	closed bool
+	err    error // result of Close
+}
+
+// NewWriter returns a Writer that deduplicates (as per opts) the data written
+// to it and writes the dedup stream to dst. Close must be called to flush the
+// final segment (and the trailer, if any) to dst.
+func NewWriter(dst io.Writer, opts Options) (*Writer, error) {
+	d, err := NewDeduplicatorWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	writer := &Writer{
+		dedup: d,
+		pipe:  w,
+		done:  make(chan error, 1),
+	}
+	go func() {
+		err := d.Do(r, dst)
+		// fail any further writes (if Do bailed early) instead of blocking them
+		r.CloseWithError(err)
+		writer.done <- err
+	}()
+	return writer, nil
+}
+
+// Write segments (and deduplicates) p. Segments are only written to the
+// underlying writer once their end is found, so output may lag input.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+// Close flushes the remaining data to the underlying writer and waits for the
+// Deduplicator to finish, returning the first error it encountered. It does
+// not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	w.pipe.Close()
+	w.err = <-w.done
+	if err := w.dedup.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
@@ -0,0 +1,144 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// writeInPieces writes data to w in pieces of random (odd) sizes
+func writeInPieces(t *testing.T, w io.Writer, data []byte, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for len(data) > 0 {
+		n := 1 + 2*rng.Intn(20000)
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be written (by a Writer) while it is
+// being looked at
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	// large enough to be segmented in parallel by the workers
+	data := testInput(3*parallelRegionSize+12345, 24)
+	for _, opts := range []Options{
+		{Workers: 1, Checksums: false},
+		{Workers: 1, Checksums: true},
+		{Workers: 4, Checksums: false},
+		{Workers: 4, Checksums: true},
+	} {
+		opts.Segmenter = testSegmenter(t, AlgorithmFastCDC)
+
+		// the stream must be the one the Deduplicator writes
+		d, err := NewDeduplicatorWithOptions(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bytes.Buffer{}
+		if err := d.Do(bytes.NewReader(data), &want); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+
+		got := &lockedBuffer{}
+		w, err := NewWriter(got, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeInPieces(t, w, data, 25)
+		// the last segment doesn't end on a cut, only Close can flush it
+		if got.Len() >= want.Len() {
+			t.Fatalf("Workers %d, checksums %v: the whole stream was written before Close", opts.Workers, opts.Checksums)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("Workers %d, checksums %v: Writer wrote %d bytes, the Deduplicator %d",
+				opts.Workers, opts.Checksums, got.Len(), want.Len())
+		}
+
+		output := bytes.Buffer{}
+		r := NewReduplicator()
+		if err := r.Do(bytes.NewReader(got.Bytes()), &output); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if !bytes.Equal(output.Bytes(), data) {
+			t.Fatalf("Workers %d, checksums %v: stream doesn't reduplicate to the input", opts.Workers, opts.Checksums)
+		}
+	}
+}
+
+func TestWriterWriteAfterClose(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, Options{Segmenter: testSegmenter(t, AlgorithmBuzhash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more data")); err == nil {
+		t.Fatalf("Expected an error writing after Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Second Close returned %v", err)
+	}
+}
+
+func TestWriterOutputError(t *testing.T) {
+	output := &failingWriter{limit: 1 << 16, err: errors.New("disk full")}
+	w, err := NewWriter(output, Options{Segmenter: testSegmenter(t, AlgorithmBuzhash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once the Deduplicator fails, writes fail instead of blocking
+	data := testInput(1<<20, 26)
+	for i := 0; i < 16; i++ {
+		if _, err = w.Write(data); err != nil {
+			break
+		}
+	}
+	if errors.Cause(err) != output.err {
+		t.Fatalf("Expected the output error from Write, got %v", err)
+	}
+	if err := w.Close(); errors.Cause(err) != output.err {
+		t.Fatalf("Expected the output error from Close, got %v", err)
+	}
+}